@@ -0,0 +1,275 @@
+package sshsync
+
+import (
+	"github.com/spf13/afero"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// temp files are hidden and named after the file they replace,
+// like .main.go.sshsync-tmp-1
+const atomicTempMarker = ".sshsync-tmp-"
+
+var atomicTempCounter uint64
+
+// whether path is a temp file of writeFile, which the watchers skip
+func isAtomicTempFile(path string) bool {
+	base := filepath.Base(path)
+	return strings.HasPrefix(base, ".") && strings.Contains(base, atomicTempMarker)
+}
+
+// a temp file name next to path that was not handed out before
+func tempPath(path string) string {
+	n := atomic.AddUint64(&atomicTempCounter, 1)
+	prefix := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+atomicTempMarker)
+	return prefix + strconv.Itoa(os.Getpid()) + "-" + strconv.FormatUint(n, 10)
+}
+
+// a new empty temp file next to path, the folder of path is created if needed
+func createTempFile(fs afero.Fs, path string, mode os.FileMode) (afero.File, string, error) {
+	err := fs.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, "", err
+	}
+	for {
+		tmpPath := tempPath(path)
+		fp, err := fs.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+		if os.IsExist(err) {
+			// left over from a crash
+			continue
+		}
+		return fp, tmpPath, err
+	}
+}
+
+// writes content to a temp file next to path and syncs it to disk, ready to be
+// renamed over path
+// new files get mode 0644 if meta doesn't have one
+// existing files keep their mode and owner unless meta has a mode
+func stageFile(fs afero.Fs, path string, content []byte, meta FileMeta) (string, error) {
+	mode := os.FileMode(0644)
+	old, statErr := fs.Stat(path)
+	if statErr == nil {
+		mode = old.Mode().Perm()
+	}
+	if meta.Mode != 0 {
+		mode = meta.Mode.Perm()
+	}
+
+	fp, tmpPath, err := createTempFile(fs, path, mode)
+	if err != nil {
+		return "", err
+	}
+	_, err = fp.Write(content)
+	if err == nil {
+		err = fp.Sync()
+	}
+	closeErr := fp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		// the umask may have taken bits away
+		err = fs.Chmod(tmpPath, mode)
+	}
+	if err == nil && statErr == nil {
+		err = copyOwner(fs, tmpPath, old)
+		if err != nil {
+			// only root can give files away, which is no reason to not write them
+			log.Println("could not keep owner of", path, err)
+			err = nil
+		}
+	}
+	if err == nil && !meta.ModTime.IsZero() {
+		err = fs.Chtimes(tmpPath, meta.ModTime, meta.ModTime)
+	}
+	if err != nil {
+		fs.Remove(tmpPath)
+		return "", err
+	}
+	return tmpPath, nil
+}
+
+// writes a single file through a temp file, so that a crash or a build running
+// at the same time never sees half of it
+func writeFile(fs afero.Fs, path string, content []byte, meta FileMeta) error {
+	tmpPath, err := stageFile(fs, path, content, meta)
+	if err != nil {
+		return err
+	}
+	err = fs.Rename(tmpPath, path)
+	if err != nil {
+		fs.Remove(tmpPath)
+	}
+	return err
+}
+
+// keeps what is at path under a temp name, so that it can be put back
+// a hard link where the fs has them, so that nothing is copied, a copy otherwise
+func backupFile(fs afero.Fs, path string, old os.FileInfo) (string, error) {
+	if _, ok := fs.(*afero.OsFs); ok {
+		for {
+			backupPath := tempPath(path)
+			err := os.Link(path, backupPath)
+			if os.IsExist(err) {
+				continue
+			}
+			if err == nil {
+				return backupPath, nil
+			}
+			log.Println("could not link", path, "copying it instead", err)
+			break
+		}
+	}
+	oldContent, err := afero.ReadFile(fs, path)
+	if err != nil {
+		return "", err
+	}
+	return stageFile(fs, path, oldContent, FileMeta{
+		Mode:    old.Mode().Perm(),
+		ModTime: old.ModTime(),
+	})
+}
+
+type stagedFile struct {
+	path string
+	// empty if path is removed
+	tmpPath string
+	// what was at path, empty if there was nothing or it needs no backup
+	backupPath string
+}
+
+// files that are written or removed all together or not at all
+// every file is staged first, so that nothing is touched if any of them can't be
+// written, then they are renamed into place and the files they replaced are put
+// back if a rename fails
+// removed files are renamed out of the way, and only removed once all went well
+type writeBatch struct {
+	fs     afero.Fs
+	staged []stagedFile
+}
+
+func (b *writeBatch) stage(path string, content []byte, meta FileMeta) error {
+	tmpPath, err := stageFile(b.fs, path, content, meta)
+	if err != nil {
+		return err
+	}
+	b.staged = append(b.staged, stagedFile{path: path, tmpPath: tmpPath})
+	return nil
+}
+
+// removes path along with the rest of the batch, nothing to do if it is gone already
+func (b *writeBatch) remove(path string) error {
+	_, err := b.fs.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	b.staged = append(b.staged, stagedFile{path: path})
+	return nil
+}
+
+// a single rename is atomic on its own, so only batches of several files
+// keep what they replace until they are done
+func (b *writeBatch) backUp() error {
+	if len(b.staged) < 2 {
+		return nil
+	}
+	for i := range b.staged {
+		staged := &b.staged[i]
+		if staged.tmpPath == "" {
+			continue
+		}
+		old, err := b.fs.Stat(staged.path)
+		if err != nil || !old.Mode().IsRegular() {
+			continue
+		}
+		staged.backupPath, err = backupFile(b.fs, staged.path, old)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removes the staged files without touching anything else
+func (b *writeBatch) abort() {
+	for _, staged := range b.staged {
+		if staged.tmpPath != "" {
+			b.fs.Remove(staged.tmpPath)
+		}
+		if staged.backupPath != "" {
+			b.fs.Remove(staged.backupPath)
+		}
+	}
+	b.staged = nil
+}
+
+// renames the staged files into place
+// if one fails, the ones before it get their old content back
+func (b *writeBatch) commit() error {
+	err := b.backUp()
+	if err != nil {
+		b.abort()
+		return err
+	}
+	for i := range b.staged {
+		staged := &b.staged[i]
+		if staged.tmpPath == "" {
+			backupPath := tempPath(staged.path)
+			err = b.fs.Rename(staged.path, backupPath)
+			if err == nil {
+				staged.backupPath = backupPath
+			}
+		} else {
+			err = b.fs.Rename(staged.tmpPath, staged.path)
+		}
+		if err == nil {
+			continue
+		}
+		for j := i - 1; j >= 0; j-- {
+			b.rollBack(b.staged[j])
+		}
+		b.staged = b.staged[i:]
+		b.abort()
+		return err
+	}
+	for _, staged := range b.staged {
+		if staged.backupPath != "" {
+			b.fs.Remove(staged.backupPath)
+		}
+	}
+	b.staged = nil
+	return nil
+}
+
+func (b *writeBatch) rollBack(staged stagedFile) {
+	var err error
+	if staged.backupPath != "" {
+		err = b.fs.Rename(staged.backupPath, staged.path)
+	} else {
+		err = b.fs.Remove(staged.path)
+	}
+	if err != nil {
+		log.Println("could not roll back", staged.path, err)
+	}
+}
+
+// writes all files or none of them
+func writeFiles(fs afero.Fs, files []BinaryFile) error {
+	batch := &writeBatch{fs: fs}
+	for _, f := range files {
+		err := batch.stage(f.Path, f.Content, f.FileMeta)
+		if err != nil {
+			batch.abort()
+			return err
+		}
+	}
+	return batch.commit()
+}
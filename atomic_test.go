@@ -0,0 +1,297 @@
+package sshsync_test
+
+import (
+	"bytes"
+	"errors"
+	"github.com/Joshua-Wright/sshsync"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestServerAtomicWrites(t *testing.T) {
+	WithFolder(t, "TestServerAtomicWrites", func(serverPath string, serverFs afero.Fs) {
+		assert.NoError(t, afero.WriteFile(serverFs, "secret.txt", []byte("old"), 0600))
+		assert.NoError(t, serverFs.Chmod("secret.txt", 0600))
+		server := sshsync.NewServerConfig(serverFs)
+		server.BuildCache()
+		clientConn, serverConn := sshsync.TwoWayPipe()
+		go server.ReadCommands(serverConn)
+		client := rpc.NewClient(clientConn)
+
+		// the mode of the file that was there is kept
+		err := client.Call(sshsync.Server_SendTextFile, sshsync.TextFile{Path: "secret.txt", Content: "new"}, nil)
+		assert.NoError(t, err)
+		AssertFileContent(t, serverFs, "secret.txt", "new")
+		info, err := serverFs.Stat("secret.txt")
+		assert.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+		delta := sshsync.MakeTextDelta("secret.txt", "new", "newer")
+		err = client.Call(sshsync.Server_Delta, sshsync.TextFileDeltas{delta}, nil)
+		assert.NoError(t, err)
+		AssertFileContent(t, serverFs, "secret.txt", "newer")
+		info, err = serverFs.Stat("secret.txt")
+		assert.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+		// a failed write leaves the file alone, and no temp files behind
+		err = client.Call(sshsync.Server_SendTextFile, sshsync.TextFile{Path: "secret.txt/new.txt", Content: "x"}, nil)
+		assert.Error(t, err)
+		AssertFileContent(t, serverFs, "secret.txt", "newer")
+		entries, err := ioutil.ReadDir(serverPath)
+		assert.NoError(t, err)
+		names := []string{}
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		assert.Equal(t, []string{"secret.txt"}, names)
+
+		client.Close()
+		clientConn.Close()
+		serverConn.Close()
+	})
+}
+
+// a reader never sees a mix of the old and the new content
+func TestServerAtomicWritesNotTorn(t *testing.T) {
+	WithFolder(t, "TestServerAtomicWritesNotTorn", func(serverPath string, serverFs afero.Fs) {
+		contents := [][]byte{
+			bytes.Repeat([]byte("a"), 1<<20),
+			bytes.Repeat([]byte("b"), 1<<20),
+		}
+		assert.NoError(t, afero.WriteFile(serverFs, "big.txt", contents[0], 0644))
+		server := sshsync.NewServerConfig(serverFs)
+		server.BuildCache()
+		clientConn, serverConn := sshsync.TwoWayPipe()
+		go server.ReadCommands(serverConn)
+		client := rpc.NewClient(clientConn)
+
+		done := make(chan bool)
+		go func() {
+			for i := 0; i < 20; i++ {
+				err := client.Call(sshsync.Server_SendTextFile, sshsync.TextFile{Path: "big.txt", Content: string(contents[i%2])}, nil)
+				assert.NoError(t, err)
+			}
+			close(done)
+		}()
+		for reading := true; reading; {
+			select {
+			case <-done:
+				reading = false
+			default:
+			}
+			buf, err := ioutil.ReadFile(filepath.Join(serverPath, "big.txt"))
+			assert.NoError(t, err)
+			if !bytes.Equal(buf, contents[0]) && !bytes.Equal(buf, contents[1]) {
+				t.Fatal("read a half written file of", len(buf), "bytes")
+			}
+		}
+
+		client.Close()
+		clientConn.Close()
+		serverConn.Close()
+	})
+}
+
+// fails renaming temp files over failPath, or failPath out of the way, like a disk
+// that fills up halfway through a batch, and creating files in failDir
+type failingFs struct {
+	afero.Fs
+	failPath string
+	failDir  string
+}
+
+func (fs *failingFs) Rename(oldname, newname string) error {
+	if newname == fs.failPath || oldname == fs.failPath {
+		return errors.New("rename failed")
+	}
+	return fs.Fs.Rename(oldname, newname)
+}
+
+func (fs *failingFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if filepath.Dir(name) == fs.failDir {
+		return nil, errors.New("create failed")
+	}
+	return fs.Fs.OpenFile(name, flag, perm)
+}
+
+func listFiles(t *testing.T, fs afero.Fs) []string {
+	files := []string{}
+	err := afero.Walk(fs, ".", func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			files = append(files, filepath.ToSlash(path))
+		}
+		return err
+	})
+	assert.NoError(t, err)
+	sort.Strings(files)
+	return files
+}
+
+func TestServerBatchAllOrNothing(t *testing.T) {
+	memFs := afero.NewMemMapFs()
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		assert.NoError(t, afero.WriteFile(memFs, name, []byte(name), 0644))
+	}
+	serverFs := &failingFs{Fs: memFs, failPath: "c.txt", failDir: "full"}
+	server := sshsync.NewServerConfig(serverFs)
+	server.BuildCache()
+	clientConn, serverConn := sshsync.TwoWayPipe()
+	go server.ReadCommands(serverConn)
+	client := rpc.NewClient(clientConn)
+
+	// the third file fails after the first two were renamed into place
+	deltas := sshsync.TextFileDeltas{}
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		deltas = append(deltas, sshsync.MakeTextDelta(name, name, name+" edited"))
+	}
+	err := client.Call(sshsync.Server_Delta, deltas, nil)
+	assert.Error(t, err)
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		AssertFileContent(t, memFs, name, name)
+		var content string
+		assert.NoError(t, client.Call(sshsync.Server_GetTextFile, name, &content))
+		assert.Equal(t, name, content)
+	}
+	assert.Equal(t, []string{"a.txt", "b.txt", "c.txt"}, listFiles(t, memFs))
+
+	// new files are removed again
+	err = client.Call(sshsync.Server_SendTextFiles, []sshsync.TextFile{
+		{Path: "new.txt", Content: "new"},
+		{Path: "c.txt", Content: "c edited"},
+	}, nil)
+	assert.Error(t, err)
+	assert.Equal(t, []string{"a.txt", "b.txt", "c.txt"}, listFiles(t, memFs))
+
+	// a file that can't even be staged stops the batch before anything is renamed
+	err = client.Call(sshsync.Server_SendTextFiles, []sshsync.TextFile{
+		{Path: "a.txt", Content: "a edited"},
+		{Path: "full/b.txt", Content: "b"},
+	}, nil)
+	assert.Error(t, err)
+	AssertFileContent(t, memFs, "a.txt", "a.txt")
+	assert.Equal(t, []string{"a.txt", "b.txt", "c.txt"}, listFiles(t, memFs))
+
+	// and without failures everything is written
+	serverFs.failPath = ""
+	err = client.Call(sshsync.Server_Delta, deltas, nil)
+	assert.NoError(t, err)
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		AssertFileContent(t, memFs, name, name+" edited")
+	}
+	assert.Equal(t, []string{"a.txt", "b.txt", "c.txt"}, listFiles(t, memFs))
+
+	client.Close()
+	clientConn.Close()
+	serverConn.Close()
+}
+
+func TestServerCommitAllOrNothing(t *testing.T) {
+	memFs := afero.NewMemMapFs()
+	old := map[string]string{"a.txt": "a", "old.txt": "old", "gone1.txt": "gone", "gone2.txt": "gone"}
+	for path, content := range old {
+		assert.NoError(t, afero.WriteFile(memFs, path, []byte(content), 0644))
+	}
+	serverFs := &failingFs{Fs: memFs, failPath: "gone2.txt"}
+	server := sshsync.NewServerConfig(serverFs)
+	server.BuildCache()
+	clientConn, serverConn := sshsync.TwoWayPipe()
+	go server.ReadCommands(serverConn)
+	client := rpc.NewClient(clientConn)
+
+	assertUnchanged := func() {
+		for path, content := range old {
+			AssertFileContent(t, memFs, path, content)
+			var cached string
+			assert.NoError(t, client.Call(sshsync.Server_GetTextFile, path, &cached))
+			assert.Equal(t, content, cached)
+		}
+		assert.Equal(t, []string{"a.txt", "gone1.txt", "gone2.txt", "old.txt"}, listFiles(t, memFs))
+	}
+
+	// deltas are made against the files at their new paths
+	commit := sshsync.Commit{
+		Renames: sshsync.FileRenames{{OldPath: "old.txt", NewPath: "dir/moved.txt"}},
+		TextDeltas: sshsync.TextFileDeltas{
+			sshsync.MakeTextDelta("a.txt", "a", "a edited"),
+			sshsync.MakeTextDelta("dir/moved.txt", "old", "old edited"),
+		},
+		Deletes: []string{"gone1.txt", "gone2.txt"},
+	}
+
+	// one delta that doesn't match the cache stops the whole commit
+	drifted := commit
+	drifted.TextDeltas = append(sshsync.TextFileDeltas{sshsync.MakeTextDelta("gone1.txt", "drifted", "x")}, commit.TextDeltas...)
+	rejected := []string{}
+	assert.NoError(t, client.Call(sshsync.Server_Commit, drifted, &rejected))
+	assert.Equal(t, []string{"gone1.txt"}, rejected)
+	assertUnchanged()
+
+	// the last delete fails after everything else is done, which is all undone
+	err := client.Call(sshsync.Server_Commit, commit, &rejected)
+	assert.Error(t, err)
+	assertUnchanged()
+
+	serverFs.failPath = ""
+	assert.NoError(t, client.Call(sshsync.Server_Commit, commit, &rejected))
+	assert.Empty(t, rejected)
+	AssertFileContent(t, memFs, "a.txt", "a edited")
+	AssertFileContent(t, memFs, "dir/moved.txt", "old edited")
+	assert.Equal(t, []string{"a.txt", "dir/moved.txt"}, listFiles(t, memFs))
+	var cached string
+	assert.NoError(t, client.Call(sshsync.Server_GetTextFile, "dir/moved.txt", &cached))
+	assert.Equal(t, "old edited", cached)
+
+	client.Close()
+	clientConn.Close()
+	serverConn.Close()
+}
+
+// on a real disk the files a batch replaces are kept by hard links, which are
+// put back just the same
+func TestServerBatchAllOrNothingOsFs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestServerBatchAllOrNothingOsFs")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	osFs := afero.NewOsFs()
+	for _, name := range []string{"a.txt", "b.txt"} {
+		assert.NoError(t, afero.WriteFile(osFs, filepath.Join(dir, name), []byte(name), 0644))
+	}
+	// a file can't be renamed over a folder that has files in it
+	assert.NoError(t, osFs.Mkdir(filepath.Join(dir, "c.txt"), 0755))
+	assert.NoError(t, afero.WriteFile(osFs, filepath.Join(dir, "c.txt", "inside.txt"), []byte("inside"), 0644))
+
+	server := sshsync.NewServerConfig(osFs)
+	clientConn, serverConn := sshsync.TwoWayPipe()
+	go server.ReadCommands(serverConn)
+	client := rpc.NewClient(clientConn)
+
+	files := []sshsync.TextFile{}
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		files = append(files, sshsync.TextFile{Path: filepath.Join(dir, name), Content: name + " edited"})
+	}
+	err = client.Call(sshsync.Server_SendTextFiles, files, nil)
+	assert.Error(t, err)
+	for _, name := range []string{"a.txt", "b.txt"} {
+		AssertFileContent(t, osFs, filepath.Join(dir, name), name)
+	}
+	assert.NoError(t, os.RemoveAll(filepath.Join(dir, "c.txt")))
+	assert.Equal(t, []string{"a.txt", "b.txt"}, listFiles(t, afero.NewBasePathFs(osFs, dir)))
+
+	err = client.Call(sshsync.Server_SendTextFiles, files, nil)
+	assert.NoError(t, err)
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		AssertFileContent(t, osFs, filepath.Join(dir, name), name+" edited")
+	}
+	assert.Equal(t, []string{"a.txt", "b.txt", "c.txt"}, listFiles(t, afero.NewBasePathFs(osFs, dir)))
+
+	client.Close()
+	clientConn.Close()
+	serverConn.Close()
+}
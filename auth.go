@@ -0,0 +1,231 @@
+package sshsync
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/term"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const passphraseTries = 3
+
+func DefaultKeyFiles() []string {
+	sshDir := filepath.Join(os.Getenv("HOME"), ".ssh")
+	return []string{
+		filepath.Join(sshDir, "id_rsa"),
+		filepath.Join(sshDir, "id_dsa"),
+		filepath.Join(sshDir, "id_ecdsa"),
+		filepath.Join(sshDir, "id_ed25519"),
+	}
+}
+
+// public key authentication with the keys of the running ssh-agent,
+// and then the key files that are not in the agent
+type SshAuth struct {
+	// unix socket of the agent, "" means $SSH_AUTH_SOCK
+	AgentSocket string
+	KeyFiles    []string
+	// asks for the passphrase of an encrypted key file, nil asks on the terminal
+	Passphrase func(keyFile string) ([]byte, error)
+
+	agentOnce sync.Once
+	agent     agent.ExtendedAgent
+
+	keysMu sync.Mutex
+	// loaded key files, so that reconnecting doesn't ask for passphrases again
+	keys map[string]ssh.Signer
+}
+
+func NewSshAuth() *SshAuth {
+	return &SshAuth{KeyFiles: DefaultKeyFiles()}
+}
+
+// the agent connection stays open, agent keys can only sign while it is
+func (a *SshAuth) getAgent() agent.ExtendedAgent {
+	a.agentOnce.Do(func() {
+		socket := a.AgentSocket
+		if socket == "" {
+			socket = os.Getenv("SSH_AUTH_SOCK")
+		}
+		if socket == "" {
+			return
+		}
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			log.Println("no ssh-agent", err)
+			return
+		}
+		a.agent = agent.NewClient(conn)
+	})
+	return a.agent
+}
+
+// all keys go in a single method, because ssh only tries every method once
+func (a *SshAuth) AuthMethods() []ssh.AuthMethod {
+	return []ssh.AuthMethod{ssh.PublicKeysCallback(a.signers)}
+}
+
+func (a *SshAuth) signers() ([]ssh.Signer, error) {
+	signers := []ssh.Signer{}
+	seen := make(map[string]bool)
+	if agentClient := a.getAgent(); agentClient != nil {
+		agentSigners, err := agentClient.Signers()
+		if err != nil {
+			log.Println("list ssh-agent keys", err)
+		}
+		for _, signer := range agentSigners {
+			seen[string(signer.PublicKey().Marshal())] = true
+			signers = append(signers, signer)
+		}
+	}
+
+	for _, keyFile := range a.KeyFiles {
+		signer, err := a.keyFileSigner(keyFile)
+		if err != nil {
+			if !os.IsNotExist(errors.Cause(err)) {
+				log.Println("load key", keyFile, err)
+			}
+			continue
+		}
+		if seen[string(signer.PublicKey().Marshal())] {
+			continue
+		}
+		seen[string(signer.PublicKey().Marshal())] = true
+		signers = append(signers, signer)
+	}
+	return signers, nil
+}
+
+// an encrypted key stays decrypted once it signed, files that failed to load are tried again
+func (a *SshAuth) keyFileSigner(keyFile string) (ssh.Signer, error) {
+	a.keysMu.Lock()
+	defer a.keysMu.Unlock()
+	if signer, ok := a.keys[keyFile]; ok {
+		return signer, nil
+	}
+	signer, err := a.loadKeyFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if a.keys == nil {
+		a.keys = make(map[string]ssh.Signer)
+	}
+	a.keys[keyFile] = signer
+	return signer, nil
+}
+
+func (a *SshAuth) loadKeyFile(keyFile string) (ssh.Signer, error) {
+	buf, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(buf)
+	missing, encrypted := err.(*ssh.PassphraseMissingError)
+	if !encrypted {
+		return signer, err
+	}
+
+	encryptedKey := &encryptedSigner{auth: a, keyFile: keyFile, pem: buf}
+	if missing.PublicKey != nil {
+		encryptedKey.publicKey = missing.PublicKey
+		return encryptedKey, nil
+	}
+	// old pem keys encrypt the public key too, it may be next to the key
+	pub, err := ioutil.ReadFile(keyFile + ".pub")
+	if err == nil {
+		encryptedKey.publicKey, _, _, _, err = ssh.ParseAuthorizedKey(pub)
+		if err == nil {
+			return encryptedKey, nil
+		}
+	}
+	err = encryptedKey.decrypt()
+	if err != nil {
+		return nil, err
+	}
+	return encryptedKey.signer, nil
+}
+
+func (a *SshAuth) askPassphrase(keyFile string) ([]byte, error) {
+	if a.Passphrase != nil {
+		return a.Passphrase(keyFile)
+	}
+	fmt.Fprintf(os.Stderr, "Enter passphrase for key '%s': ", keyFile)
+	defer fmt.Fprintln(os.Stderr)
+	return term.ReadPassword(int(os.Stdin.Fd()))
+}
+
+// only asks for the passphrase once the server accepted the public key
+type encryptedSigner struct {
+	auth      *SshAuth
+	keyFile   string
+	pem       []byte
+	publicKey ssh.PublicKey
+
+	// the signer is shared by every connection of the SshAuth
+	mu     sync.Mutex
+	signer ssh.AlgorithmSigner
+}
+
+func (s *encryptedSigner) decrypt() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.signer != nil {
+		return nil
+	}
+	var err error
+	for try := 0; try < passphraseTries; try++ {
+		var passphrase []byte
+		passphrase, err = s.auth.askPassphrase(s.keyFile)
+		if err != nil {
+			return err
+		}
+		var signer ssh.Signer
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(s.pem, passphrase)
+		if err != nil {
+			log.Println("bad passphrase for", s.keyFile)
+			continue
+		}
+		algorithmSigner, ok := signer.(ssh.AlgorithmSigner)
+		if !ok {
+			return errors.New("unsupported key type in " + s.keyFile)
+		}
+		if s.publicKey != nil && !bytes.Equal(signer.PublicKey().Marshal(), s.publicKey.Marshal()) {
+			return errors.New("public key does not match " + s.keyFile)
+		}
+		s.signer = algorithmSigner
+		return nil
+	}
+	return errors.Wrap(err, "decrypt "+s.keyFile)
+}
+
+func (s *encryptedSigner) PublicKey() ssh.PublicKey {
+	if s.publicKey == nil {
+		return s.signer.PublicKey()
+	}
+	return s.publicKey
+}
+
+func (s *encryptedSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	err := s.decrypt()
+	if err != nil {
+		return nil, err
+	}
+	return s.signer.Sign(rand, data)
+}
+
+func (s *encryptedSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	err := s.decrypt()
+	if err != nil {
+		return nil, err
+	}
+	return s.signer.SignWithAlgorithm(rand, data, algorithm)
+}
@@ -0,0 +1,249 @@
+package sshsync_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"github.com/Joshua-Wright/sshsync"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+type testSshServer struct {
+	Address string
+	HostKey ssh.PublicKey
+	Stop    func()
+
+	mu sync.Mutex
+	// addresses of direct-tcpip channels
+	forwarded []string
+	// stop answering global requests, like a half open connection
+	hang bool
+	// logged in clients that are still connected
+	connections int
+}
+
+func (s *testSshServer) Connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connections
+}
+
+func (s *testSshServer) Hang() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hang = true
+}
+
+func (s *testSshServer) handleRequests(reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		s.mu.Lock()
+		hang := s.hang
+		s.mu.Unlock()
+		if !hang && req.WantReply {
+			req.Reply(false, nil)
+		}
+	}
+}
+
+func (s *testSshServer) Forwarded() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.forwarded...)
+}
+
+// forwards a direct-tcpip channel, like a jump host does for ssh -J
+func (s *testSshServer) forwardChannel(newChan ssh.NewChannel) {
+	payload := struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}{}
+	err := ssh.Unmarshal(newChan.ExtraData(), &payload)
+	if err != nil {
+		newChan.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	address := net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port)))
+	s.mu.Lock()
+	s.forwarded = append(s.forwarded, address)
+	s.mu.Unlock()
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		newChan.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	channel, reqs, err := newChan.Accept()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	go func() {
+		io.Copy(channel, conn)
+		channel.CloseWrite()
+	}()
+	go func() {
+		io.Copy(conn, channel)
+		conn.Close()
+	}()
+}
+
+// ssh server on localhost that only lets in authorizedKey, and can be used as a jump host
+func startSshServer(t *testing.T, authorizedKey ssh.PublicKey) *testSshServer {
+	_, hostPriv, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	hostSigner, err := ssh.NewSignerFromKey(hostPriv)
+	assert.NoError(t, err)
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), authorizedKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, os.ErrPermission
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	server := &testSshServer{
+		Address: listener.Addr().String(),
+		HostKey: hostSigner.PublicKey(),
+		Stop:    func() { listener.Close() },
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, chans, reqs, err := ssh.NewServerConn(conn, config)
+				if err != nil {
+					conn.Close()
+					return
+				}
+				server.mu.Lock()
+				server.connections++
+				server.mu.Unlock()
+				go server.handleRequests(reqs)
+				for newChan := range chans {
+					if newChan.ChannelType() == "direct-tcpip" {
+						go server.forwardChannel(newChan)
+						continue
+					}
+					newChan.Reject(ssh.Prohibited, "no sessions in this test")
+				}
+				server.mu.Lock()
+				server.connections--
+				server.mu.Unlock()
+			}()
+		}
+	}()
+	return server
+}
+
+func newUserKey(t *testing.T) (ed25519.PrivateKey, ssh.PublicKey) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	sshPub, err := ssh.NewPublicKey(pub)
+	assert.NoError(t, err)
+	return priv, sshPub
+}
+
+func dialWithAuth(address string, auth *sshsync.SshAuth) error {
+	client, err := ssh.Dial("tcp", address, &ssh.ClientConfig{
+		User:            "user",
+		Auth:            auth.AuthMethods(),
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err == nil {
+		client.Close()
+	}
+	return err
+}
+
+func TestSshAuthAgent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestSshAuthAgent")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	priv, pub := newUserKey(t)
+	keyring := agent.NewKeyring()
+	assert.NoError(t, keyring.Add(agent.AddedKey{PrivateKey: priv}))
+	socket := filepath.Join(dir, "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	assert.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(keyring, conn)
+		}
+	}()
+
+	server := startSshServer(t, pub)
+	defer server.Stop()
+	auth := &sshsync.SshAuth{AgentSocket: socket}
+	assert.NoError(t, dialWithAuth(server.Address, auth))
+
+	// without the agent there is no key
+	auth = &sshsync.SshAuth{AgentSocket: filepath.Join(dir, "missing.sock")}
+	assert.Error(t, dialWithAuth(server.Address, auth))
+}
+
+func TestSshAuthEncryptedKeyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestSshAuthEncryptedKeyFile")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	keyFiles := []string{}
+	var authorized ssh.PublicKey
+	for _, name := range []string{"id_other", "id_ed25519"} {
+		priv, pub := newUserKey(t)
+		block, err := ssh.MarshalPrivateKeyWithPassphrase(priv, "", []byte("secret"))
+		assert.NoError(t, err)
+		keyFile := filepath.Join(dir, name)
+		assert.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(block), 0600))
+		keyFiles = append(keyFiles, keyFile)
+		authorized = pub
+	}
+
+	server := startSshServer(t, authorized)
+	defer server.Stop()
+
+	// only the key the server accepts asks for its passphrase, and a wrong one is asked again
+	asked := []string{}
+	auth := &sshsync.SshAuth{
+		AgentSocket: filepath.Join(dir, "missing.sock"),
+		KeyFiles:    append(keyFiles, filepath.Join(dir, "id_missing")),
+		Passphrase: func(keyFile string) ([]byte, error) {
+			asked = append(asked, keyFile)
+			if len(asked) == 1 {
+				return []byte("wrong"), nil
+			}
+			return []byte("secret"), nil
+		},
+	}
+	assert.NoError(t, dialWithAuth(server.Address, auth))
+	assert.Equal(t, []string{keyFiles[1], keyFiles[1]}, asked)
+
+	// reconnecting uses the decrypted key
+	assert.NoError(t, dialWithAuth(server.Address, auth))
+	assert.Len(t, asked, 2)
+}
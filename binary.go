@@ -0,0 +1,71 @@
+package sshsync
+
+import (
+	"bytes"
+	"github.com/pkg/errors"
+	"unicode/utf8"
+)
+
+// files that diffmatchpatch can't handle are sent as raw bytes instead
+type BinaryFile struct {
+	Path    string
+	Content []byte
+	FileMeta
+}
+
+// keeps the first Prefix and last Suffix bytes of the old content,
+// and replaces everything in between with Data
+type BinaryFileDelta struct {
+	Path   string
+	Prefix int
+	Suffix int
+	Data   []byte
+	// crc64 of the content the delta was made against, and of the result
+	BaseChecksum   uint64
+	ResultChecksum uint64
+	FileMeta
+}
+type BinaryFileDeltas []BinaryFileDelta
+
+// only look this far for NUL bytes, same as git
+const binarySniffLength = 8000
+
+// diffmatchpatch works on runes, so anything that isn't valid utf8 would get mangled
+func IsBinary(content []byte) bool {
+	sniff := content
+	if len(sniff) > binarySniffLength {
+		sniff = sniff[:binarySniffLength]
+	}
+	return bytes.IndexByte(sniff, 0) != -1 || !utf8.Valid(content)
+}
+
+func MakeBinaryDelta(path string, oldContent, newContent []byte) BinaryFileDelta {
+	prefix := 0
+	for prefix < len(oldContent) && prefix < len(newContent) && oldContent[prefix] == newContent[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(oldContent)-prefix && suffix < len(newContent)-prefix &&
+		oldContent[len(oldContent)-1-suffix] == newContent[len(newContent)-1-suffix] {
+		suffix++
+	}
+	return BinaryFileDelta{
+		Path:           path,
+		Prefix:         prefix,
+		Suffix:         suffix,
+		Data:           newContent[prefix : len(newContent)-suffix],
+		BaseChecksum:   crc64checksum(string(oldContent)),
+		ResultChecksum: crc64checksum(string(newContent)),
+	}
+}
+
+func ApplyBinaryDelta(oldContent []byte, delta BinaryFileDelta) ([]byte, error) {
+	if delta.Prefix < 0 || delta.Suffix < 0 || delta.Prefix+delta.Suffix > len(oldContent) {
+		return nil, errors.New("binary delta does not fit " + delta.Path)
+	}
+	newContent := make([]byte, 0, delta.Prefix+len(delta.Data)+delta.Suffix)
+	newContent = append(newContent, oldContent[:delta.Prefix]...)
+	newContent = append(newContent, delta.Data...)
+	newContent = append(newContent, oldContent[len(oldContent)-delta.Suffix:]...)
+	return newContent, nil
+}
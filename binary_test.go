@@ -0,0 +1,49 @@
+package sshsync_test
+
+import (
+	"github.com/Joshua-Wright/sshsync"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestIsBinary(t *testing.T) {
+	assert.False(t, sshsync.IsBinary([]byte("plain text\n")))
+	assert.False(t, sshsync.IsBinary([]byte("unicode: ünïcödé ✓\n")))
+	assert.False(t, sshsync.IsBinary([]byte{}))
+	assert.True(t, sshsync.IsBinary([]byte("nul\x00byte")))
+	assert.True(t, sshsync.IsBinary([]byte{0xff, 0xfe, 'a'}))
+	assert.True(t, sshsync.IsBinary([]byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n'}))
+}
+
+func TestBinaryDelta(t *testing.T) {
+	cases := []struct {
+		old, new []byte
+	}{
+		{[]byte{}, []byte{}},
+		{[]byte{}, []byte{0, 1, 2}},
+		{[]byte{0, 1, 2}, []byte{}},
+		{[]byte{0, 1, 2, 3}, []byte{0, 1, 2, 3}},
+		{[]byte{0, 1, 2, 3}, []byte{0, 0xff, 3}},
+		{[]byte{0, 1, 2, 3}, []byte{0, 1, 2, 3, 4}},
+		{[]byte{0, 1, 2, 3}, []byte{9, 0, 1, 2, 3}},
+		// repeated bytes must not be counted in both the prefix and suffix
+		{[]byte{7, 7, 7}, []byte{7, 7, 7, 7}},
+		{[]byte{7, 7, 7, 7}, []byte{7, 7}},
+	}
+	for _, testCase := range cases {
+		delta := sshsync.MakeBinaryDelta("file.bin", testCase.old, testCase.new)
+		result, err := sshsync.ApplyBinaryDelta(testCase.old, delta)
+		assert.NoError(t, err)
+		assert.Equal(t, testCase.new, result, "%v -> %v", testCase.old, testCase.new)
+	}
+
+	// only the changed bytes are sent
+	delta := sshsync.MakeBinaryDelta("file.bin", []byte{0, 1, 2, 3}, []byte{0, 0xff, 3})
+	assert.Equal(t, 1, delta.Prefix)
+	assert.Equal(t, 1, delta.Suffix)
+	assert.Equal(t, []byte{0xff}, delta.Data)
+
+	// delta for a different base is rejected
+	_, err := sshsync.ApplyBinaryDelta([]byte{0}, delta)
+	assert.Error(t, err)
+}
@@ -0,0 +1,23 @@
+//go:build !windows
+// +build !windows
+
+package sshsync
+
+import (
+	"github.com/spf13/afero"
+	"os"
+	"syscall"
+)
+
+// gives path the same owner and group as the file info came from
+func copyOwner(fs afero.Fs, path string, info os.FileInfo) error {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		// not a file on disk, like in a MemMapFs
+		return nil
+	}
+	if int(stat.Uid) == os.Geteuid() && int(stat.Gid) == os.Getegid() {
+		return nil
+	}
+	return fs.Chown(path, int(stat.Uid), int(stat.Gid))
+}
@@ -0,0 +1,42 @@
+//go:build !windows
+// +build !windows
+
+package sshsync_test
+
+import (
+	"github.com/Joshua-Wright/sshsync"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestServerAtomicWritesKeepOwner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("only root can change owners")
+	}
+	WithFolder(t, "TestServerAtomicWritesKeepOwner", func(serverPath string, serverFs afero.Fs) {
+		assert.NoError(t, afero.WriteFile(serverFs, "owned.txt", []byte("old"), 0644))
+		assert.NoError(t, os.Chown(filepath.Join(serverPath, "owned.txt"), 1234, 5678))
+		server := sshsync.NewServerConfig(serverFs)
+		server.BuildCache()
+		clientConn, serverConn := sshsync.TwoWayPipe()
+		go server.ReadCommands(serverConn)
+		client := rpc.NewClient(clientConn)
+
+		err := client.Call(sshsync.Server_SendTextFile, sshsync.TextFile{Path: "owned.txt", Content: "new"}, nil)
+		assert.NoError(t, err)
+		info, err := os.Stat(filepath.Join(serverPath, "owned.txt"))
+		assert.NoError(t, err)
+		stat := info.Sys().(*syscall.Stat_t)
+		assert.Equal(t, uint32(1234), stat.Uid)
+		assert.Equal(t, uint32(5678), stat.Gid)
+
+		client.Close()
+		clientConn.Close()
+		serverConn.Close()
+	})
+}
@@ -0,0 +1,14 @@
+//go:build windows
+// +build windows
+
+package sshsync
+
+import (
+	"github.com/spf13/afero"
+	"os"
+)
+
+// files on windows have no uid and gid to keep
+func copyOwner(fs afero.Fs, path string, info os.FileInfo) error {
+	return nil
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/sergi/go-diff/diffmatchpatch"
 	"github.com/spf13/afero"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
@@ -28,10 +29,28 @@ type ClientFolder struct {
 	FileCache   map[string]string
 	ExitChannel chan bool
 	Client      *rpc.Client
+	// opens a new connection when the old one drops, nil to not reconnect
+	Dial func() (io.ReadWriteCloser, error)
+	// what the server said about itself in Hello
+	ServerInfo HelloReply
+	// index hashes to offer the server, nil offers all of Hashes
+	Hashes []string
+	// files bigger than this use rsync deltas
+	// 0 means DefaultRsyncThreshold, negative turns rsync deltas off
+	RsyncThreshold int
+	// give synced files a new modification time instead of keeping the original
+	TouchModTime bool
+	// last synced version of every file, for three-way merges
+	// nil keeps them in memory
+	BaseFs afero.Fs
+	// what AutoResolveWithServer does with files changed on both sides
+	ConflictPolicy ConflictPolicy
 }
 
 func (c *ClientFolder) Close() {
-	c.Client.Close()
+	if c.Client != nil {
+		c.Client.Close()
+	}
 }
 
 func (c *ClientFolder) makePathAbsolute(path string) string {
@@ -51,10 +70,19 @@ func (c *ClientFolder) makePathRelative(absPath string) string {
 	return strings.TrimPrefix(absPath, basePath)
 }
 
+func (c *ClientFolder) fileMeta(path string) FileMeta {
+	meta := statFileMeta(c.ClientFs, path)
+	if c.TouchModTime {
+		meta.ModTime = time.Time{}
+	}
+	return meta
+}
+
 func (c *ClientFolder) SendCompleteTextFile(path string) error {
 	textFile := TextFile{
-		Path:    path,
-		Content: c.FileCache[path],
+		Path:     path,
+		Content:  c.FileCache[path],
+		FileMeta: c.fileMeta(path),
 	}
 	return c.Client.Call(Server_SendTextFile, textFile, nil)
 }
@@ -62,12 +90,52 @@ func (c *ClientFolder) SendCompleteTextFiles(paths []string) error {
 	textFiles := make([]TextFile, len(paths))
 	for i, _ := range textFiles {
 		textFiles[i] = TextFile{
-			Path:    paths[i],
-			Content: c.FileCache[paths[i]],
+			Path:     paths[i],
+			Content:  c.FileCache[paths[i]],
+			FileMeta: c.fileMeta(paths[i]),
 		}
 	}
 	return c.Client.Call(Server_SendTextFiles, textFiles, nil)
 }
+func (c *ClientFolder) SendCompleteBinaryFiles(paths []string) error {
+	binaryFiles := make([]BinaryFile, len(paths))
+	for i := range binaryFiles {
+		binaryFiles[i] = BinaryFile{
+			Path:     paths[i],
+			Content:  []byte(c.FileCache[paths[i]]),
+			FileMeta: c.fileMeta(paths[i]),
+		}
+	}
+	return c.Client.Call(Server_SendBinaryFiles, binaryFiles, nil)
+}
+
+// sends text and binary files from the cache each the right way
+func (c *ClientFolder) SendCompleteFiles(paths []string) error {
+	textPaths := []string{}
+	binaryPaths := []string{}
+	for _, path := range paths {
+		if IsBinary([]byte(c.FileCache[path])) {
+			binaryPaths = append(binaryPaths, path)
+		} else {
+			textPaths = append(textPaths, path)
+		}
+	}
+	err := c.SendCompleteTextFiles(textPaths)
+	if err != nil {
+		return err
+	}
+	if len(binaryPaths) > 0 {
+		err = c.SendCompleteBinaryFiles(binaryPaths)
+		if err != nil {
+			return err
+		}
+	}
+	for _, path := range paths {
+		c.saveBase(path, c.FileCache[path])
+	}
+	return nil
+}
+
 func (c *ClientFolder) GetCompleteTextFile(path string) (string, error) {
 	content := ""
 	err := c.Client.Call(Server_GetTextFile, path, &content)
@@ -79,10 +147,49 @@ func (c *ClientFolder) GetCompleteTextFiles(paths []string) ([]TextFile, error)
 	return content, err
 }
 
-func (c *ClientFolder) SendFileDiffs(files map[string]bool) error {
-	buf := TextFileDeltas{}
+func (c *ClientFolder) useRsync(oldSize, newSize int) bool {
+	threshold := c.RsyncThreshold
+	if threshold == 0 {
+		threshold = DefaultRsyncThreshold
+	}
+	return threshold > 0 && (oldSize > threshold || newSize > threshold)
+}
 
+// asks the server which blocks it has, and makes deltas of the rest
+func (c *ClientFolder) rsyncDeltas(files map[string][]byte) (RsyncDeltas, error) {
+	paths := make([]string, 0, len(files))
 	for path := range files {
+		paths = append(paths, path)
+	}
+	sigs := []FileSignature{}
+	err := c.Client.Call(Server_GetSignatures, paths, &sigs)
+	if err != nil {
+		return nil, err
+	}
+	deltas := make(RsyncDeltas, len(sigs))
+	for i, sig := range sigs {
+		deltas[i] = ComputeRsyncDelta(sig, files[sig.Path])
+		deltas[i].FileMeta = c.fileMeta(sig.Path)
+	}
+	return deltas, nil
+}
+
+func (c *ClientFolder) SendFileDiffs(files map[string]bool) error {
+	return c.sendCommit(nil, files, nil)
+}
+
+// sends renames, edits and deletes as one Commit, so that the server never has
+// only some of them
+func (c *ClientFolder) sendCommit(renames FileRenames, modified, deleted map[string]bool) error {
+	commit := Commit{Renames: renames}
+	rsyncFiles := make(map[string][]byte)
+	// what the commit carries, so the cache follows it once it got through
+	sent := make(map[string]string)
+
+	for _, rename := range renames {
+		log.Println("rename: ", rename.OldPath, rename.NewPath)
+	}
+	for path := range modified {
 		log.Println("update: ", path)
 
 		newBuf, err := afero.ReadFile(c.ClientFs, path)
@@ -92,17 +199,447 @@ func (c *ClientFolder) SendFileDiffs(files map[string]bool) error {
 			continue
 		}
 		newStr := string(newBuf)
+		oldStr := c.FileCache[path]
+		meta := c.fileMeta(path)
+		sent[path] = newStr
+
+		if c.useRsync(len(oldStr), len(newBuf)) {
+			rsyncFiles[c.makePathRelative(path)] = newBuf
+		} else if IsBinary(newBuf) || IsBinary([]byte(oldStr)) {
+			binaryDelta := MakeBinaryDelta(c.makePathRelative(path), []byte(oldStr), newBuf)
+			binaryDelta.FileMeta = meta
+			commit.BinaryDeltas = append(commit.BinaryDeltas, binaryDelta)
+		} else {
+			delta := MakeTextDelta(c.makePathRelative(path), oldStr, newStr)
+			delta.FileMeta = meta
+			commit.TextDeltas = append(commit.TextDeltas, delta)
+		}
+	}
+	if len(rsyncFiles) > 0 {
+		var err error
+		commit.RsyncDeltas, err = c.rsyncDeltas(rsyncFiles)
+		if err != nil {
+			return err
+		}
+	}
+	for path := range deleted {
+		log.Println("delete: ", path)
+		commit.Deletes = append(commit.Deletes, path)
+	}
+
+	rejected := []string{}
+	err := c.Client.Call(Server_Commit, commit, &rejected)
+	if err == nil && len(rejected) > 0 {
+		// nothing was applied, so the commit goes again with those files whole,
+		// which can't be rejected
+		c.sendWhole(&commit, rejected, sent)
+		err = c.Client.Call(Server_Commit, commit, &rejected)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, rename := range renames {
+		c.renameBase(rename.OldPath, rename.NewPath)
+	}
+	c.synced(sent)
+	for path := range deleted {
+		delete(c.FileCache, path)
+		c.removeBase(path)
+	}
+	return nil
+}
+
+// only update the cache once the server has it, so that a failed send is sent again,
+// and a send that went through isn't made against the old content again
+func (c *ClientFolder) synced(sent map[string]string) {
+	for path, content := range sent {
+		c.FileCache[path] = content
+		c.saveBase(path, content)
+	}
+}
+
+// swaps the deltas the server could not apply, because its copy is not what the
+// client thought it was, for whole files
+// paths are the server's and contents are keyed by the client's
+func (c *ClientFolder) sendWhole(commit *Commit, paths []string, contents map[string]string) {
+	whole := make(map[string]bool, len(paths))
+	localPaths := c.localPaths(contents)
+	for _, path := range paths {
+		log.Println("server copy differs, sending whole file", path)
+		whole[path] = true
+		local := localPaths[path]
+		commit.Files = append(commit.Files, BinaryFile{
+			Path:     path,
+			Content:  []byte(contents[local]),
+			FileMeta: c.fileMeta(local),
+		})
+	}
+	textDeltas := TextFileDeltas{}
+	for _, delta := range commit.TextDeltas {
+		if !whole[delta.Path] {
+			textDeltas = append(textDeltas, delta)
+		}
+	}
+	binaryDeltas := BinaryFileDeltas{}
+	for _, delta := range commit.BinaryDeltas {
+		if !whole[delta.Path] {
+			binaryDeltas = append(binaryDeltas, delta)
+		}
+	}
+	rsyncDeltas := RsyncDeltas{}
+	for _, delta := range commit.RsyncDeltas {
+		if !whole[delta.Path] {
+			rsyncDeltas = append(rsyncDeltas, delta)
+		}
+	}
+	commit.TextDeltas, commit.BinaryDeltas, commit.RsyncDeltas = textDeltas, binaryDeltas, rsyncDeltas
+}
+
+// map of the server's path to the client's, for the paths in files
+func (c *ClientFolder) localPaths(files map[string]string) map[string]string {
+	localPaths := make(map[string]string, len(files))
+	for path := range files {
+		localPaths[c.makePathRelative(path)] = path
+	}
+	return localPaths
+}
+
+// paths in the cache at path, or below path if it was a folder
+func (c *ClientFolder) trackedPaths(path string) []string {
+	paths := []string{}
+	for cachedPath := range c.FileCache {
+		if inPath(cachedPath, path) {
+			paths = append(paths, cachedPath)
+		}
+	}
+	return paths
+}
+
+func (c *ClientFolder) SendFileDeletes(files map[string]bool) error {
+	if len(files) == 0 {
+		return nil
+	}
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		log.Println("delete: ", path)
+		delete(c.FileCache, path)
+		paths = append(paths, path)
+	}
+	err := c.Client.Call(Server_DeleteFiles, paths, nil)
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		c.removeBase(path)
+	}
+	return nil
+}
+
+// changes collected by the watcher during one commit window
+type pendingChanges struct {
+	modified map[string]bool
+	deleted  map[string]bool
+	renames  FileRenames
+	// paths that were renamed away, waiting for the create event at their new path
+	renamedFrom []string
+}
+
+func newPendingChanges() *pendingChanges {
+	return &pendingChanges{
+		modified: make(map[string]bool),
+		deleted:  make(map[string]bool),
+	}
+}
+
+func (p *pendingChanges) addRenamedFrom(path string) {
+	for _, existing := range p.renamedFrom {
+		if existing == path {
+			return
+		}
+	}
+	p.renamedFrom = append(p.renamedFrom, path)
+}
+
+// a file was made again where one was renamed away, like editors that save by
+// renaming the old file to a backup, so it isn't gone after all
+func (p *pendingChanges) removeRenamedFrom(path string) {
+	for i, existing := range p.renamedFrom {
+		if existing == path {
+			p.renamedFrom = append(p.renamedFrom[:i], p.renamedFrom[i+1:]...)
+			return
+		}
+	}
+}
+
+// records a rename, and moves pending changes along with it
+func (p *pendingChanges) addRename(oldPath, newPath string) {
+	p.renames = append(p.renames, FileRename{oldPath, newPath})
+	// whatever was deleted at the new path gets replaced by the rename
+	for path := range p.deleted {
+		if inPath(path, newPath) {
+			delete(p.deleted, path)
+		}
+	}
+	for _, set := range []map[string]bool{p.modified, p.deleted} {
+		moved := []string{}
+		for path := range set {
+			if renamed, ok := renamedPath(path, oldPath, newPath); ok {
+				delete(set, path)
+				moved = append(moved, renamed)
+			}
+		}
+		for _, path := range moved {
+			set[path] = true
+		}
+	}
+}
+
+// renames go first, so that diffs and deletes apply to the new paths
+func (c *ClientFolder) commitChanges(changes *pendingChanges) error {
+	// renames that never got a matching create moved out of the folder,
+	// unless something was made at the same path again
+	for _, oldPath := range changes.renamedFrom {
+		for _, path := range c.trackedPaths(oldPath) {
+			if _, err := c.ClientFs.Stat(path); err == nil {
+				changes.modified[path] = true
+				continue
+			}
+			changes.deleted[path] = true
+			delete(changes.modified, path)
+		}
+	}
+	changes.renamedFrom = nil
+
+	// the cache is updated as renames are detected, so they only tell the server
+	err := c.sendCommit(changes.renames, changes.modified, changes.deleted)
+	if err != nil {
+		return err
+	}
+	changes.renames = nil
+	changes.modified = make(map[string]bool)
+	changes.deleted = make(map[string]bool)
+	return nil
+}
+
+// whether the file or folder at path is what used to be at oldPath
+func (c *ClientFolder) isMovedFrom(oldPath, path string, info os.FileInfo) bool {
+	tracked := c.trackedPaths(oldPath)
+	if len(tracked) == 0 {
+		return false
+	}
+	for _, trackedPath := range tracked {
+		newPath, _ := renamedPath(trackedPath, oldPath, path)
+		if c.IgnoreCfg.ShouldIgnore(c.ClientFs, newPath) {
+			return false
+		}
+	}
+	if info.IsDir() {
+		// a file can't be renamed to a folder
+		_, isFile := c.FileCache[oldPath]
+		return !isFile
+	}
+
+	cached, ok := c.FileCache[oldPath]
+	if !ok || int64(len(cached)) != info.Size() {
+		return false
+	}
+	buf, err := afero.ReadFile(c.ClientFs, path)
+	return err == nil && string(buf) == cached
+}
+
+// pairs a create event with an earlier rename, so that the file or folder is moved
+// on the server instead of being sent again
+func (c *ClientFolder) matchRename(watcher *fsnotify.Watcher, path string, info os.FileInfo, changes *pendingChanges) bool {
+	for i, oldPath := range changes.renamedFrom {
+		if !c.isMovedFrom(oldPath, path, info) {
+			continue
+		}
+		changes.renamedFrom = append(changes.renamedFrom[:i], changes.renamedFrom[i+1:]...)
+		changes.addRename(oldPath, path)
+		renameCacheEntries(c.FileCache, oldPath, path)
+
+		// watches stay attached to the moved folder under its old name
+		watcher.Remove(c.makePathAbsolute(oldPath))
+		err := c.addWatchTree(watcher, path, nil)
+		if err != nil {
+			log.Println("failed to watch renamed path", err)
+		}
+		return true
+	}
+	return false
+}
+
+// updates changes for a single watcher event
+// returns false if there is nothing new to send
+func (c *ClientFolder) handleEvent(watcher *fsnotify.Watcher, event fsnotify.Event, changes *pendingChanges) bool {
+	absPath := event.Name
+	path := c.makePathRelative(absPath)
+	if isAtomicTempFile(path) {
+		// written by applyServerChanges, the rename that follows is what counts
+		return false
+	}
+	if IsIgnoreConfigFile(path) {
+		return c.reloadIgnoreConfig(watcher, changes)
+	}
+
+	info, err := c.ClientFs.Stat(path)
+	if err != nil {
+		if event.Op&(fsnotify.Remove|fsnotify.Rename) == 0 {
+			return false
+		}
+		// removed paths can't be checked against the ignore config,
+		// so only delete what was in the cache
+		removed := c.trackedPaths(path)
+		if len(removed) == 0 {
+			return false
+		}
+		if event.Op&fsnotify.Rename != 0 {
+			// probably followed by a create at the new path
+			changes.addRenamedFrom(path)
+			return true
+		}
+		for _, removedPath := range removed {
+			changes.deleted[removedPath] = true
+			delete(changes.modified, removedPath)
+		}
+		return true
+	}
+
+	if !info.IsDir() {
+		changes.removeRenamedFrom(path)
+	}
+	if event.Op&fsnotify.Create != 0 && c.matchRename(watcher, path, info, changes) {
+		return true
+	}
+
+	if info.IsDir() {
+		if event.Op&fsnotify.Create == 0 {
+			return false
+		}
+		// files may have been created before the folder was watched
+		err = c.addWatchTree(watcher, path, func(newPath string) {
+			changes.modified[newPath] = true
+			delete(changes.deleted, newPath)
+		})
+		if err != nil {
+			log.Println("failed to watch new folder", err)
+		}
+		return true
+	}
+
+	if c.IgnoreCfg.ShouldIgnore(c.ClientFs, path) {
+		return false
+	}
+
+	err = watcher.Add(absPath)
+	die("add new watch", err)
+	changes.modified[path] = true
+	delete(changes.deleted, path)
+	return true
+}
 
-		// calculate diff
-		diffs := dmp.DiffMain(c.FileCache[path], newStr, false)
-		delta := dmp.DiffToDelta(diffs)
+// long polls the server for changes made on its side, until the connection
+// goes away or done is closed
+// the client is passed in, because c.Client is replaced when reconnecting
+func (c *ClientFolder) pollServerChanges(client *rpc.Client, remoteChanges chan<- []FileChange, lost chan<- *rpc.Client, done <-chan bool) {
+	for {
+		changes := []FileChange{}
+		err := client.Call(Server_PollChanges, 0, &changes)
+		if err != nil {
+			log.Println("stopped polling server for changes", err)
+			if IsConnectionError(err) {
+				select {
+				case lost <- client:
+				case <-done:
+				}
+			}
+			return
+		}
+		if len(changes) == 0 {
+			continue
+		}
+		select {
+		case remoteChanges <- changes:
+		case <-done:
+			return
+		}
+	}
+}
+
+// applies edits made on the server to the cache and disk
+// files with local changes waiting to be sent are handled by ConflictPolicy
+func (c *ClientFolder) applyServerChanges(remote []FileChange, changes *pendingChanges) {
+	for _, change := range remote {
+		localChange := changes.modified[change.Path]
+		if change.Deleted {
+			log.Println("deleted on server: ", change.Path)
+			delete(c.FileCache, change.Path)
+			delete(changes.deleted, change.Path)
+			c.removeBase(change.Path)
+			if !localChange {
+				err := c.ClientFs.Remove(change.Path)
+				if err != nil && !os.IsNotExist(err) {
+					log.Println("failed to delete", change.Path, err)
+				}
+			}
+			continue
+		}
 
-		// update cache
-		c.FileCache[path] = newStr
-		// write to buffer
-		buf = append(buf, TextFileDelta{c.makePathRelative(path), delta})
+		if changes.deleted[change.Path] {
+			// deleting locally wins too
+			continue
+		}
+		log.Println("changed on server: ", change.Path)
+		var err error
+		if localChange {
+			err = c.resolveServerChange(change.TextFile, changes)
+		} else {
+			err = c.writeLocalFile(change.Path, change.Content, change.FileMeta)
+		}
+		if err != nil {
+			log.Println("failed to write", change.Path, err)
+		}
 	}
-	return c.Client.Call(Server_Delta, buf, nil)
+}
+
+// a server edit to a file that was also changed here and not sent yet
+// the cache still has what was synced last, which is the base for merging
+func (c *ClientFolder) resolveServerChange(serverFile TextFile, changes *pendingChanges) error {
+	path := serverFile.Path
+	base := c.FileCache[path]
+	buf, err := afero.ReadFile(c.ClientFs, path)
+	if err != nil {
+		// deleted here meanwhile, the delete is sent with the next commit
+		c.FileCache[path] = serverFile.Content
+		return nil
+	}
+	ours := string(buf)
+	if ours == serverFile.Content || ours == base {
+		delete(changes.modified, path)
+		return c.writeLocalFile(path, serverFile.Content, serverFile.FileMeta)
+	}
+
+	sendPaths := []string{}
+	resolved, err := c.resolveConflict(serverFile, base, ours, &sendPaths)
+	if err != nil {
+		return err
+	}
+	// local deltas have to be made against what the server has now
+	c.FileCache[path] = serverFile.Content
+	c.saveBase(path, serverFile.Content)
+	if !resolved {
+		// nothing to stop while watching, so the server's version is kept next to
+		// the local one, which is only sent when it is saved again
+		delete(changes.modified, path)
+		return c.writeConflictCopy(serverFile)
+	}
+
+	delete(changes.modified, path)
+	for _, sendPath := range sendPaths {
+		changes.modified[sendPath] = true
+	}
+	return nil
 }
 
 func (c *ClientFolder) StopWatchFiles() {
@@ -126,50 +663,86 @@ func (c *ClientFolder) StartWatchFiles(foreground bool) error {
 	}
 
 	bgfunc := func() {
-		var err error
 		waitingForCommit := false
 		shouldCommit := make(chan bool, 1)
-		var filesToAdd = make(map[string]bool)
+		changes := newPendingChanges()
+		commitAfter := func(delay time.Duration) {
+			waitingForCommit = true
+			go func() {
+				time.Sleep(delay)
+				shouldCommit <- true
+			}()
+		}
+
+		remoteChanges := make(chan []FileChange)
+		lost := make(chan *rpc.Client)
+		done := make(chan bool)
+		defer close(done)
+		go c.pollServerChanges(c.Client, remoteChanges, lost, done)
+		connected := true
+		reconnectDelay := reconnectMinDelay
+		disconnected := func() {
+			if connected && c.Dial != nil {
+				connected = false
+				reconnectDelay = reconnectMinDelay
+				if !waitingForCommit {
+					commitAfter(reconnectDelay)
+				}
+			}
+		}
 
 		for {
 			select {
+			case remote := <-remoteChanges:
+				c.applyServerChanges(remote, changes)
+
+			case client := <-lost:
+				// pollers of old connections stop after reconnecting too
+				if client == c.Client {
+					disconnected()
+				}
+
 			case <-shouldCommit:
-				err := c.SendFileDiffs(filesToAdd)
-				if err != nil {
+				if !connected {
+					err := c.Reconnect()
+					// no client means that dialing or the handshake failed
+					if err != nil && (c.Client == nil || IsConnectionError(err)) {
+						log.Println("failed to reconnect, trying again in", reconnectDelay, err)
+						commitAfter(reconnectDelay)
+						reconnectDelay = nextReconnectDelay(reconnectDelay)
+						continue
+					}
+					if err != nil {
+						// conflicts are left for the user, like when starting up
+						log.Println("after reconnecting", err)
+					}
+					// everything that was queued went out with the resync
+					connected = true
+					changes = newPendingChanges()
+					waitingForCommit = false
+					go c.pollServerChanges(c.Client, remoteChanges, lost, done)
+					continue
+				}
+
+				err := c.commitChanges(changes)
+				if IsConnectionError(err) && c.Dial != nil {
+					log.Println("lost connection to server", err)
+					disconnected()
+					commitAfter(reconnectDelay)
+				} else if err != nil {
 					log.Println("failed to send, will retry", err)
-					waitingForCommit = true
-					go func() {
-						time.Sleep(commitTimeout)
-						shouldCommit <- true
-					}()
+					commitAfter(commitTimeout)
 				} else {
 					waitingForCommit = false
-					filesToAdd = make(map[string]bool)
 				}
 
 			case event := <-watcher.Events:
-				absPath := event.Name
-				path := c.makePathRelative(absPath)
-
-				if c.IgnoreCfg.ShouldIgnore(c.ClientFs, path) {
+				if !c.handleEvent(watcher, event, changes) {
 					continue
 				}
 
-				err = watcher.Add(absPath)
-				die("add new watch", err)
-				info, err2 := c.ClientFs.Stat(path)
-
-				// do not diff folders
-				if err2 == nil && !info.IsDir() {
-					filesToAdd[path] = true
-				}
-
 				if !waitingForCommit {
-					waitingForCommit = true
-					go func() {
-						time.Sleep(commitTimeout)
-						shouldCommit <- true
-					}()
+					commitAfter(commitTimeout)
 				}
 
 			case err := <-watcher.Errors:
@@ -199,17 +772,31 @@ func (c *ClientFolder) AddWatches(watcher *fsnotify.Watcher) error {
 		return err
 	}
 
-	return afero.Walk(c.ClientFs, ".", func(path string, info os.FileInfo, err error) error {
+	return c.addWatchTree(watcher, ".", nil)
+}
+
+// watches root and everything below it
+// found is called for every file that is not ignored
+func (c *ClientFolder) addWatchTree(watcher *fsnotify.Watcher, root string, found func(path string)) error {
+	return afero.Walk(c.ClientFs, root, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
+		if info.IsDir() && c.IgnoreCfg.IgnoresDir(c.ClientFs, path) {
+			return filepath.SkipDir
+		}
 
 		// explicitly make sure to watch folders (to make sure that new files are watched)
 		if info.IsDir() || !c.IgnoreCfg.ShouldIgnore(c.ClientFs, path) {
 			log.Println("Path", path)
 			log.Println("abs Path", c.makePathAbsolute(path))
 			err := watcher.Add(c.makePathAbsolute(path))
-			die("add initial watch", err)
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() && found != nil {
+				found(path)
+			}
 		}
 		return nil
 	})
@@ -221,6 +808,9 @@ func (c *ClientFolder) BuildCache() error {
 		if err != nil {
 			return err
 		}
+		if info.IsDir() && c.IgnoreCfg.IgnoresDir(c.ClientFs, path) {
+			return filepath.SkipDir
+		}
 
 		if !info.IsDir() && !c.IgnoreCfg.ShouldIgnore(c.ClientFs, path) {
 			// add only files to cache
@@ -233,13 +823,49 @@ func (c *ClientFolder) BuildCache() error {
 	})
 }
 
-func (c *ClientFolder) getServerChecksums() (map[string]uint64, error) {
-	out := make(map[string]uint64)
-	err := c.Client.Call(Server_GetFileHashes, 0, &out)
-	return out, err
+// files where size and modification time are the same on both sides count as
+// the same, like rsync does, only the rest are hashed
+func (c *ClientFolder) compareWithServer(paths []string, serverIndex FileIndex) (match, mismatch []string, err error) {
+	hashPaths := []string{}
+	for _, path := range paths {
+		serverEntry := serverIndex[path]
+		clientContent := c.FileCache[path]
+		if serverEntry.Size != int64(len(clientContent)) {
+			mismatch = append(mismatch, path)
+			continue
+		}
+		modTime := statFileMeta(c.ClientFs, path).ModTime
+		if !modTime.IsZero() && modTime.Equal(serverEntry.ModTime) {
+			match = append(match, path)
+			continue
+		}
+		hashPaths = append(hashPaths, path)
+	}
+	if len(hashPaths) == 0 {
+		return
+	}
+
+	hash := c.indexHash()
+	hashes := make(FileIndex)
+	err = c.Client.Call(Server_GetFileHashes, FileIndexRequest{Hash: hash, Paths: hashPaths}, &hashes)
+	if err != nil {
+		return
+	}
+	for _, path := range hashPaths {
+		clientHash, err := hashContent(hash, c.FileCache[path])
+		if err != nil {
+			return nil, nil, err
+		}
+		if serverEntry, ok := hashes[path]; ok && serverEntry.Hash == clientHash {
+			match = append(match, path)
+		} else {
+			mismatch = append(mismatch, path)
+		}
+	}
+	return
 }
 
-func (c *ClientFolder) CheckClientServerIndexes() (client, server, match, mismatch []string) {
+func (c *ClientFolder) CheckClientServerIndexes() (client, server, match, mismatch []string, err error) {
 	if c.FileCache == nil {
 		c.BuildCache()
 	}
@@ -250,32 +876,35 @@ func (c *ClientFolder) CheckClientServerIndexes() (client, server, match, mismat
 	matchM := make(map[string]bool)
 	mismatchM := make(map[string]bool)
 
-	serverIndex, err := c.getServerChecksums()
-	die("", err)
-	for path, serverCheck := range serverIndex {
-		if clientContent, ok := c.FileCache[path]; ok {
-			clientCheck := crc64checksum(clientContent)
-			if serverCheck == clientCheck {
-				matchM[path] = true
-			} else {
-				mismatchM[path] = true
-			}
-		} else {
+	// sizes and modification times first, hashes only where they don't tell
+	serverIndex := make(FileIndex)
+	err = c.Client.Call(Server_GetFileHashes, FileIndexRequest{}, &serverIndex)
+	if err != nil {
+		return
+	}
+	for path := range serverIndex {
+		if _, ok := c.FileCache[path]; !ok {
 			serverM[path] = true
 		}
 	}
-	for path, clientContent := range c.FileCache {
-		clientCheck := crc64checksum(clientContent)
-		if serverCheck, ok := serverIndex[path]; ok {
-			if serverCheck == clientCheck {
-				matchM[path] = true
-			} else {
-				mismatchM[path] = true
-			}
+	both := []string{}
+	for path := range c.FileCache {
+		if _, ok := serverIndex[path]; ok {
+			both = append(both, path)
 		} else {
 			clientM[path] = true
 		}
 	}
+	matched, mismatched, err := c.compareWithServer(both, serverIndex)
+	if err != nil {
+		return
+	}
+	for _, path := range matched {
+		matchM[path] = true
+	}
+	for _, path := range mismatched {
+		mismatchM[path] = true
+	}
 
 	// copy into output arrays
 	client = make([]string, 0, len(clientM))
@@ -298,7 +927,10 @@ func (c *ClientFolder) CheckClientServerIndexes() (client, server, match, mismat
 }
 
 func (c *ClientFolder) AssertClientAndServerMatch() error {
-	client, server, _, mismatch := c.CheckClientServerIndexes()
+	client, server, _, mismatch, err := c.CheckClientServerIndexes()
+	if err != nil {
+		return err
+	}
 	if len(client) == 0 && len(server) == 0 && len(mismatch) == 0 {
 		return nil
 	} else {
@@ -317,38 +949,187 @@ func (c *ClientFolder) AssertClientAndServerMatch() error {
 	}
 }
 
+// pushes local permission bits for files that are on both sides
+func (c *ClientFolder) SendFileModes(paths []string) error {
+	serverModes := FileModeIndex{}
+	err := c.Client.Call(Server_GetFileModes, 0, &serverModes)
+	if err != nil {
+		return err
+	}
+	changed := FileModeIndex{}
+	for _, path := range paths {
+		mode := c.fileMeta(path).Mode
+		if serverMode, ok := serverModes[path]; ok && mode != 0 && mode != serverMode {
+			changed[path] = mode
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	return c.Client.Call(Server_Chmod, changed, nil)
+}
+
+// brings client and server in line before watching
+// files changed on only one side since the last sync go the other way,
+// files changed on both are handled by ConflictPolicy
 func (c *ClientFolder) AutoResolveWithServer() error {
-	client, server, _, mismatch := c.CheckClientServerIndexes()
-	if len(mismatch) != 0 {
-		errorText := &bytes.Buffer{}
-		fmt.Fprintln(errorText, "Client-Server mismatch:")
-		for _, path := range mismatch {
-			fmt.Fprintln(errorText, "Crc64 mismatch:", path)
+	client, server, match, mismatch, err := c.CheckClientServerIndexes()
+	if err != nil {
+		return err
+	}
+
+	// what both sides have is the base for the next sync
+	for _, path := range match {
+		c.saveBase(path, c.FileCache[path])
+	}
+
+	sendPaths := []string{}
+	for _, path := range client {
+		if base, ok := c.loadBase(path); ok && base == c.FileCache[path] {
+			// unchanged here since the last sync, so it was deleted on the server
+			log.Println("deleted on server: ", path)
+			err := c.removeLocalFile(path)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		sendPaths = append(sendPaths, path)
+	}
+
+	serverFiles, err := c.GetCompleteTextFiles(append(server, mismatch...))
+	if err != nil {
+		return err
+	}
+	serverDeletes := make(map[string]bool)
+	conflicts := []string{}
+	for _, file := range serverFiles {
+		ours, onClient := c.FileCache[file.Path]
+		base, hasBase := c.loadBase(file.Path)
+		switch {
+		case !onClient && hasBase && base == file.Content:
+			// unchanged on the server since the last sync, so it was deleted here
+			serverDeletes[file.Path] = true
+		case !onClient, hasBase && base == ours:
+			err = c.writeLocalFile(file.Path, file.Content, file.FileMeta)
+		case hasBase && base == file.Content:
+			sendPaths = append(sendPaths, file.Path)
+		default:
+			var resolved bool
+			resolved, err = c.resolveConflict(file, base, ours, &sendPaths)
+			if err == nil && !resolved {
+				conflicts = append(conflicts, file.Path)
+			}
+		}
+		if err != nil {
+			return err
 		}
-		return errors.New((errorText.String()))
 	}
-	// FIXME: send multiple files at a time (like in an array)
-	c.SendCompleteTextFiles(client)
-	textFiles, err := c.GetCompleteTextFiles(server)
+
+	err = c.SendCompleteFiles(sendPaths)
+	if err != nil {
+		return err
+	}
+	err = c.SendFileDeletes(serverDeletes)
 	if err != nil {
 		return err
 	}
-	for _, file := range textFiles {
-		c.FileCache[file.Path] = file.Content
-		afero.WriteFile(c.ClientFs, file.Path, []byte(file.Content), 0644)
+	err = c.SendFileModes(match)
+	if err != nil {
+		return err
+	}
+	if len(conflicts) != 0 {
+		errorText := &bytes.Buffer{}
+		fmt.Fprintln(errorText, "Client-Server conflict:")
+		for _, path := range conflicts {
+			fmt.Fprintln(errorText, "changed on both sides:", path)
+		}
+		return errors.New(errorText.String())
 	}
 	return nil
 }
 
+// applies ConflictPolicy to a file that changed on both sides
+// returns false if the conflict is left for the user
+func (c *ClientFolder) resolveConflict(serverFile TextFile, base, ours string, sendPaths *[]string) (bool, error) {
+	path := serverFile.Path
+	switch c.ConflictPolicy {
+	case ConflictClientWins:
+		*sendPaths = append(*sendPaths, path)
+		return true, nil
+
+	case ConflictServerWins:
+		return true, c.writeLocalFile(path, serverFile.Content, serverFile.FileMeta)
+
+	case ConflictMerge:
+		if IsBinary([]byte(ours)) || IsBinary([]byte(serverFile.Content)) {
+			// keep both copies, the server's next to the client's
+			err := c.writeConflictCopy(serverFile)
+			if err != nil {
+				return false, err
+			}
+			*sendPaths = append(*sendPaths, path)
+			return true, nil
+		}
+		merged, clean := MergeText(base, ours, serverFile.Content)
+		if !clean {
+			log.Println("conflict, wrote conflict markers to", path)
+		}
+		err := c.writeLocalFile(path, merged, c.fileMeta(path))
+		if err != nil {
+			return false, err
+		}
+		*sendPaths = append(*sendPaths, path)
+		return true, nil
+	}
+	log.Println("conflict: ", path)
+	return false, nil
+}
+
 ////////////////////////////////////////////
 
 type argT struct {
 	cli.Helper
-	ServerAddress  string `cli:"*addr" usage:"server address"`
-	ServerUsername string `cli:"user" usage:"server username" dft:"$USER"`
-	ServerPort     string `cli:"port" usage:"server port" dft:"22"`
+	ServerAddress  string `cli:"*addr" usage:"server address or ssh config alias"`
+	ServerUsername string `cli:"user" usage:"server username (default from ssh config, or $USER)"`
+	ServerPort     string `cli:"port" usage:"server port (default from ssh config, or 22)"`
 	ServerPath     string `cli:"*remote" usage:"server Path"`
 	LocalPath      string `cli:"*local" usage:"local Path"`
+	RsyncThreshold int    `cli:"rsync-threshold" usage:"use rsync deltas for files bigger than this many bytes (negative to disable)" dft:"1048576"`
+	TouchModTime   bool   `cli:"touch" usage:"give synced files the time of the sync as modification time, instead of the original"`
+	Conflict       string `cli:"conflict" usage:"what to do with files changed on both sides: manual, client-wins, server-wins or merge" dft:"manual"`
+	HostKeys       string `cli:"host-key-checking" usage:"for servers not in known_hosts: ask, accept-new or strict" dft:"ask"`
+	KnownHosts     string `cli:"known-hosts" usage:"known_hosts file" dft:"$HOME/.ssh/known_hosts"`
+	SshConfig      string `cli:"ssh-config" usage:"ssh config file to use instead of ~/.ssh/config and /etc/ssh/ssh_config"`
+	Jump           string `cli:"J,jump" usage:"jump hosts to connect through, [user@]host[:port] separated by commas (default ProxyJump from ssh config, none to turn off)"`
+	KeepAlive      int    `cli:"keepalive" usage:"seconds between keepalives to the server, 0 to turn off" dft:"15"`
+	KeepAliveCount int    `cli:"keepalive-count" usage:"unanswered keepalives before the connection counts as dead" dft:"3"`
+	Compression    string `cli:"compression" usage:"compress the connection with zstd, gzip or none (default picks the best both sides have)" dft:"auto"`
+	Hash           string `cli:"hash" usage:"hash for comparing files with the server: xxh3, blake3 or sha256 (default picks the best both sides have)" dft:"auto"`
+	ServerCommand  string `cli:"server-command" usage:"command that starts sshsync on the server (default finds it, or uploads this one to ~/.cache/sshsync)"`
+}
+
+// finds the server and its jump hosts in the ssh config, flags override what it says
+func (argv *argT) resolveHosts() (server SshHost, jumps []SshHost, err error) {
+	sshConfig := DefaultSshConfig()
+	if argv.SshConfig != "" {
+		sshConfig = LoadSshConfig(argv.SshConfig)
+	}
+	server, err = sshConfig.Resolve(argv.ServerAddress)
+	if err != nil {
+		return
+	}
+	if argv.ServerUsername != "" {
+		server.User = argv.ServerUsername
+	}
+	if argv.ServerPort != "" {
+		server.Port = argv.ServerPort
+	}
+	if argv.Jump != "" {
+		server.ProxyJump = argv.Jump
+	}
+	jumps, err = sshConfig.ResolveJumps(server.ProxyJump)
+	return
 }
 
 func ClientMain() {
@@ -359,19 +1140,70 @@ func ClientMain() {
 		var dir = argv.LocalPath
 		err := os.Chdir(dir)
 		die("chdir", err)
+		conflictPolicy, err := ParseConflictPolicy(argv.Conflict)
+		die("conflict policy", err)
+		hostKeyChecking, err := ParseHostKeyChecking(argv.HostKeys)
+		die("host key checking", err)
+		host, jumpHosts, err := argv.resolveHosts()
+		die("read ssh config", err)
 
 		c := &ClientFolder{
-			ClientFs: afero.NewBasePathFs(afero.NewOsFs(), dir),
-			BasePath: dir,
-			// TODO configurable
-			IgnoreCfg: DefaultIgnoreConfig,
+			ClientFs:  afero.NewBasePathFs(afero.NewOsFs(), dir),
+			BasePath:  dir,
 			FileCache: make(map[string]string),
+
+			RsyncThreshold: argv.RsyncThreshold,
+			TouchModTime:   argv.TouchModTime,
+			ConflictPolicy: conflictPolicy,
 		}
 		defer c.Close()
+		c.IgnoreCfg, err = LoadIgnoreConfig(c.ClientFs)
+		die("read config", err)
 
-		conn, err := OpenSshConnection(argv.ServerPath, argv.ServerUsername, argv.ServerAddress+":"+argv.ServerPort)
+		// every hop is checked against the same known_hosts
+		hostKeys := NewHostKeyVerifier(hostKeyChecking, argv.KnownHosts)
+		server := NewSshHop(host, hostKeys)
+		jumps := []SshHop{}
+		for _, jumpHost := range jumpHosts {
+			jumps = append(jumps, NewSshHop(jumpHost, hostKeys))
+		}
+		compressions := Compressions
+		if argv.Compression != "auto" {
+			if !hasFeature(Compressions, argv.Compression) {
+				die("compression", errors.New("unknown compression: "+argv.Compression))
+			}
+			compressions = []string{argv.Compression}
+		}
+		if argv.Hash != "auto" {
+			if pickHash([]string{argv.Hash}) == "" {
+				die("hash", errors.New("unknown hash: "+argv.Hash))
+			}
+			c.Hashes = []string{argv.Hash}
+		}
+		c.Dial = func() (io.ReadWriteCloser, error) {
+			conn, err := OpenSshConnection(argv.ServerPath, argv.ServerCommand, server, jumps, KeepAliveConfig{
+				Interval:  time.Duration(argv.KeepAlive) * time.Second,
+				MaxMissed: argv.KeepAliveCount,
+			})
+			if err != nil {
+				return nil, err
+			}
+			conn, compression, err := OfferCompression(conn, compressions)
+			if err != nil {
+				return nil, err
+			}
+			log.Println("compression", compression)
+			return conn, nil
+		}
+		conn, err := c.Dial()
 		die("open ssh connection", err)
 		c.Client = rpc.NewClient(conn)
+		err = c.Hello()
+		die("hello", err)
+		err = c.SendIgnoreConfig()
+		die("send ignore config", err)
+		c.BaseFs, err = openBaseFs(server.User+"@"+server.Address+":"+argv.ServerPath, dir)
+		die("open base folder", err)
 		err = c.BuildCache()
 		die("build cache", err)
 		for path, _ := range c.FileCache {
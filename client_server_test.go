@@ -6,8 +6,13 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/Joshua-Wright/sshsync"
 	"net/rpc"
+	"github.com/pkg/errors"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 )
 
 func WithClientServerFolders(t *testing.T, testName string, f func(absPath string, clientFs afero.Fs, serverFs afero.Fs)) {
@@ -64,6 +69,59 @@ func TestClientAssertMatchServer(t *testing.T) {
 		assert.Error(t, err)
 	})
 
+	// content of the same size is told apart by every hash
+	for _, hash := range sshsync.Hashes {
+		WithClientServerFolders(t, testName, func(clientPath string, clientFs afero.Fs, serverFs afero.Fs) {
+			assert.NoError(t, afero.WriteFile(serverFs, "sameSize.go", []byte("server content"), 0644))
+			assert.NoError(t, afero.WriteFile(clientFs, "sameSize.go", []byte("client content"), 0644))
+			assert.NoError(t, afero.WriteFile(serverFs, "sameFile.go", []byte("same content"), 0644))
+			assert.NoError(t, afero.WriteFile(clientFs, "sameFile.go", []byte("same content"), 0644))
+			server := sshsync.NewServerConfig(serverFs)
+			server.BuildCache()
+			clientConn, serverConn := sshsync.TwoWayPipe()
+			go server.ReadCommands(serverConn)
+			c := &sshsync.ClientFolder{
+				BasePath:  clientPath,
+				ClientFs:  clientFs,
+				FileCache: make(map[string]string),
+				Client:    rpc.NewClient(clientConn),
+				Hashes:    []string{hash},
+			}
+			defer c.Close()
+			assert.NoError(t, c.Hello())
+			assert.Equal(t, hash, c.ServerInfo.Hash)
+			c.BuildCache()
+			_, _, match, mismatch, err := c.CheckClientServerIndexes()
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"sameFile.go"}, match, hash)
+			assert.Equal(t, []string{"sameSize.go"}, mismatch, hash)
+		})
+	}
+
+	// the same size and modification time count as the same file without hashing
+	WithClientServerFolders(t, testName, func(clientPath string, clientFs afero.Fs, serverFs afero.Fs) {
+		modTime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+		assert.NoError(t, afero.WriteFile(serverFs, "touched.go", []byte("server content"), 0644))
+		assert.NoError(t, afero.WriteFile(clientFs, "touched.go", []byte("client content"), 0644))
+		assert.NoError(t, serverFs.Chtimes("touched.go", modTime, modTime))
+		assert.NoError(t, clientFs.Chtimes("touched.go", modTime, modTime))
+		server := sshsync.NewServerConfig(serverFs)
+		server.BuildCache()
+		clientConn, serverConn := sshsync.TwoWayPipe()
+		go server.ReadCommands(serverConn)
+		c := &sshsync.ClientFolder{
+			BasePath:  clientPath,
+			ClientFs:  clientFs,
+			FileCache: make(map[string]string),
+			Client:    rpc.NewClient(clientConn),
+		}
+		defer c.Close()
+		c.BuildCache()
+		_, _, match, _, err := c.CheckClientServerIndexes()
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"touched.go"}, match)
+	})
+
 	// completely different files makes error
 	WithClientServerFolders(t, testName, func(clientPath string, clientFs afero.Fs, serverFs afero.Fs) {
 		var err error
@@ -153,4 +211,423 @@ func TestClientServerAutoResolve(t *testing.T) {
 	})
 }
 
+func TestClientServerAutoResolveBinary(t *testing.T) {
+	testName := "TestClientServerAutoResolveBinary"
+
+	WithClientServerFolders(t, testName, func(clientPath string, clientFs afero.Fs, serverFs afero.Fs) {
+		binaryContent := []byte{0x7f, 'E', 'L', 'F', 0, 0xff, 0xc3, 0x28}
+		assert.NoError(t, afero.WriteFile(clientFs, "program.bin", binaryContent, 0644))
+		server := sshsync.NewServerConfig(serverFs)
+		server.BuildCache()
+		clientConn, serverConn := sshsync.TwoWayPipe()
+		go server.ReadCommands(serverConn)
+		c := &sshsync.ClientFolder{
+			BasePath:  clientPath,
+			ClientFs:  clientFs,
+			IgnoreCfg: sshsync.DefaultIgnoreConfig,
+			FileCache: make(map[string]string),
+			Client:    rpc.NewClient(clientConn),
+		}
+		c.BuildCache()
+		err := c.AutoResolveWithServer()
+		assert.NoError(t, err)
+		AssertFileContent(t, serverFs, "program.bin", string(binaryContent))
+		assert.NoError(t, c.AssertClientAndServerMatch())
+	})
+}
+
+// unlike MemMapFs, a real folder needs the folders of a file before it can be written
+func TestClientServerAutoResolveSubfolders(t *testing.T) {
+	WithFolder(t, "TestClientServerAutoResolveSubfolders", func(clientPath string, clientFs afero.Fs) {
+		WithFolder(t, "TestClientServerAutoResolveSubfoldersServer", func(serverPath string, serverFs afero.Fs) {
+			assert.NoError(t, clientFs.MkdirAll("sub/dir", 0755))
+			assert.NoError(t, afero.WriteFile(clientFs, "sub/dir/file.txt", []byte("deep"), 0644))
+			assert.NoError(t, afero.WriteFile(clientFs, "top.txt", []byte("top"), 0644))
+			server := sshsync.NewServerConfig(serverFs)
+			server.BuildCache()
+			clientConn, serverConn := sshsync.TwoWayPipe()
+			go server.ReadCommands(serverConn)
+			c := &sshsync.ClientFolder{
+				BasePath:  clientPath,
+				ClientFs:  clientFs,
+				FileCache: make(map[string]string),
+				Client:    rpc.NewClient(clientConn),
+			}
+			c.BuildCache()
+			assert.NoError(t, c.AutoResolveWithServer())
+			AssertFileContent(t, serverFs, "sub/dir/file.txt", "deep")
+			AssertFileContent(t, serverFs, "top.txt", "top")
+			assert.NoError(t, c.AssertClientAndServerMatch())
+		})
+	})
+}
+
+func TestClientServerRsyncDiffs(t *testing.T) {
+	testName := "TestClientServerRsyncDiffs"
+
+	WithClientServerFolders(t, testName, func(clientPath string, clientFs afero.Fs, serverFs afero.Fs) {
+		original := strings.Repeat("generated line\n", 1000)
+		changed := strings.Replace(original, "generated line", "edited line", 1)
+		assert.NoError(t, afero.WriteFile(serverFs, "generated.txt", []byte(original), 0644))
+		assert.NoError(t, afero.WriteFile(clientFs, "generated.txt", []byte(original), 0644))
+		server := sshsync.NewServerConfig(serverFs)
+		server.BuildCache()
+		clientConn, serverConn := sshsync.TwoWayPipe()
+		go server.ReadCommands(serverConn)
+		c := &sshsync.ClientFolder{
+			BasePath:       clientPath,
+			ClientFs:       clientFs,
+			IgnoreCfg:      sshsync.DefaultIgnoreConfig,
+			FileCache:      make(map[string]string),
+			Client:         rpc.NewClient(clientConn),
+			RsyncThreshold: 1024,
+		}
+		c.BuildCache()
+
+		assert.NoError(t, afero.WriteFile(clientFs, "generated.txt", []byte(changed), 0644))
+		err := c.SendFileDiffs(map[string]bool{"generated.txt": true})
+		assert.NoError(t, err)
+		AssertFileContent(t, serverFs, "generated.txt", changed)
+		assert.NoError(t, c.AssertClientAndServerMatch())
+	})
+}
+
+func TestClientServerAutoResolveModes(t *testing.T) {
+	testName := "TestClientServerAutoResolveModes"
+
+	WithClientServerFolders(t, testName, func(clientPath string, clientFs afero.Fs, serverFs afero.Fs) {
+		assert.NoError(t, afero.WriteFile(clientFs, "client.sh", []byte("echo client"), 0644))
+		assert.NoError(t, clientFs.Chmod("client.sh", 0755))
+		assert.NoError(t, afero.WriteFile(serverFs, "server.sh", []byte("echo server"), 0644))
+		assert.NoError(t, serverFs.Chmod("server.sh", 0750))
+		// same content, only the mode differs
+		assert.NoError(t, afero.WriteFile(clientFs, "both.sh", []byte("echo both"), 0644))
+		assert.NoError(t, clientFs.Chmod("both.sh", 0700))
+		assert.NoError(t, afero.WriteFile(serverFs, "both.sh", []byte("echo both"), 0644))
+
+		server := sshsync.NewServerConfig(serverFs)
+		server.BuildCache()
+		clientConn, serverConn := sshsync.TwoWayPipe()
+		go server.ReadCommands(serverConn)
+		c := &sshsync.ClientFolder{
+			BasePath:  clientPath,
+			ClientFs:  clientFs,
+			IgnoreCfg: sshsync.DefaultIgnoreConfig,
+			FileCache: make(map[string]string),
+			Client:    rpc.NewClient(clientConn),
+		}
+		c.BuildCache()
+		assert.NoError(t, c.AutoResolveWithServer())
+
+		AssertFileMode(t, serverFs, "client.sh", 0755)
+		AssertFileMode(t, clientFs, "server.sh", 0750)
+		AssertFileMode(t, serverFs, "both.sh", 0700)
+	})
+}
+
+func TestClientServerAutoResolveThreeWay(t *testing.T) {
+	testName := "TestClientServerAutoResolveThreeWay"
+	base := "first line\nsecond line\nthird line\n"
+
+	for _, policy := range []sshsync.ConflictPolicy{sshsync.ConflictManual, sshsync.ConflictMerge} {
+		WithClientServerFolders(t, testName, func(clientPath string, clientFs afero.Fs, serverFs afero.Fs) {
+			baseFs := afero.NewMemMapFs()
+			for _, path := range []string{"client.txt", "server.txt", "both.txt", "deletedOnServer.txt", "deletedOnClient.txt"} {
+				assert.NoError(t, afero.WriteFile(baseFs, path, []byte(base), 0644))
+			}
+			// changed on one side only
+			assert.NoError(t, afero.WriteFile(clientFs, "client.txt", []byte("client\n"), 0644))
+			assert.NoError(t, afero.WriteFile(serverFs, "client.txt", []byte(base), 0644))
+			assert.NoError(t, afero.WriteFile(clientFs, "server.txt", []byte(base), 0644))
+			assert.NoError(t, afero.WriteFile(serverFs, "server.txt", []byte("server\n"), 0644))
+			// changed on both sides
+			assert.NoError(t, afero.WriteFile(clientFs, "both.txt", []byte("first client\nsecond line\nthird line\n"), 0644))
+			assert.NoError(t, afero.WriteFile(serverFs, "both.txt", []byte("first line\nsecond line\nthird server\n"), 0644))
+			// deleted on one side
+			assert.NoError(t, afero.WriteFile(clientFs, "deletedOnServer.txt", []byte(base), 0644))
+			assert.NoError(t, afero.WriteFile(serverFs, "deletedOnClient.txt", []byte(base), 0644))
+
+			server := sshsync.NewServerConfig(serverFs)
+			server.BuildCache()
+			clientConn, serverConn := sshsync.TwoWayPipe()
+			go server.ReadCommands(serverConn)
+			c := &sshsync.ClientFolder{
+				BasePath:       clientPath,
+				ClientFs:       clientFs,
+				IgnoreCfg:      sshsync.DefaultIgnoreConfig,
+				FileCache:      make(map[string]string),
+				Client:         rpc.NewClient(clientConn),
+				BaseFs:         baseFs,
+				ConflictPolicy: policy,
+			}
+			c.BuildCache()
+			err := c.AutoResolveWithServer()
+
+			AssertFileContent(t, serverFs, "client.txt", "client\n")
+			AssertFileContent(t, clientFs, "server.txt", "server\n")
+			AssertFileContent(t, baseFs, "server.txt", "server\n")
+			_, err2 := clientFs.Stat("deletedOnServer.txt")
+			assert.True(t, os.IsNotExist(err2))
+			_, err2 = serverFs.Stat("deletedOnClient.txt")
+			assert.True(t, os.IsNotExist(err2))
+
+			if policy == sshsync.ConflictManual {
+				assert.Error(t, err)
+				// both sides keep their version
+				AssertFileContent(t, clientFs, "both.txt", "first client\nsecond line\nthird line\n")
+				AssertFileContent(t, serverFs, "both.txt", "first line\nsecond line\nthird server\n")
+			} else {
+				assert.NoError(t, err)
+				AssertFileContent(t, clientFs, "both.txt", "first client\nsecond line\nthird server\n")
+				AssertFileContent(t, serverFs, "both.txt", "first client\nsecond line\nthird server\n")
+				assert.NoError(t, c.AssertClientAndServerMatch())
+			}
+		})
+	}
+}
+
+func TestClientServerAutoResolveBinaryConflict(t *testing.T) {
+	testName := "TestClientServerAutoResolveBinaryConflict"
+
+	WithClientServerFolders(t, testName, func(clientPath string, clientFs afero.Fs, serverFs afero.Fs) {
+		clientContent := string([]byte{'c', 0, 1})
+		serverContent := string([]byte{'s', 0, 2})
+		assert.NoError(t, afero.WriteFile(clientFs, "data.bin", []byte(clientContent), 0644))
+		assert.NoError(t, afero.WriteFile(serverFs, "data.bin", []byte(serverContent), 0644))
+
+		server := sshsync.NewServerConfig(serverFs)
+		server.BuildCache()
+		clientConn, serverConn := sshsync.TwoWayPipe()
+		go server.ReadCommands(serverConn)
+		c := &sshsync.ClientFolder{
+			BasePath:       clientPath,
+			ClientFs:       clientFs,
+			IgnoreCfg:      sshsync.DefaultIgnoreConfig,
+			FileCache:      make(map[string]string),
+			Client:         rpc.NewClient(clientConn),
+			ConflictPolicy: sshsync.ConflictMerge,
+		}
+		c.BuildCache()
+		assert.NoError(t, c.AutoResolveWithServer())
+
+		// the server's copy is only kept on the client, conflict copies are never synced
+		AssertFileContent(t, clientFs, "data.bin", clientContent)
+		AssertFileContent(t, serverFs, "data.bin", clientContent)
+		AssertFileContent(t, clientFs, "data.bin.sshsync-server", serverContent)
+		_, err := serverFs.Stat("data.bin.sshsync-server")
+		assert.True(t, os.IsNotExist(err))
+		assert.True(t, c.IgnoreCfg.ShouldIgnore(clientFs, "data.bin.sshsync-server"))
+		assert.NotContains(t, c.FileCache, "data.bin.sshsync-server")
+		assert.NoError(t, c.AssertClientAndServerMatch())
+	})
+}
+
+func TestClientServerReconnect(t *testing.T) {
+	testName := "TestClientServerReconnect"
+
+	WithClientServerFolders(t, testName, func(clientPath string, clientFs afero.Fs, serverFs afero.Fs) {
+		for _, path := range []string{"edited.txt", "deleted.txt"} {
+			assert.NoError(t, afero.WriteFile(serverFs, path, []byte("original"), 0644))
+			assert.NoError(t, afero.WriteFile(clientFs, path, []byte("original"), 0644))
+		}
+		server := sshsync.NewServerConfig(serverFs)
+		server.BuildCache()
+
+		var serverConn io.ReadWriteCloser
+		var served chan bool
+		dials := 0
+		c := &sshsync.ClientFolder{
+			BasePath:  clientPath,
+			ClientFs:  clientFs,
+			IgnoreCfg: sshsync.DefaultIgnoreConfig,
+			FileCache: make(map[string]string),
+		}
+		c.Dial = func() (io.ReadWriteCloser, error) {
+			if served != nil {
+				<-served
+			}
+			dials++
+			var clientConn io.ReadWriteCloser
+			clientConn, serverConn = sshsync.TwoWayPipe()
+			served = make(chan bool)
+			go func(conn io.ReadWriteCloser, served chan bool) {
+				server.ReadCommands(conn)
+				close(served)
+			}(serverConn, served)
+			return clientConn, nil
+		}
+		assert.NoError(t, c.Reconnect())
+		assert.NoError(t, c.AssertClientAndServerMatch())
+
+		// the connection drops, and the edit can't be sent
+		serverConn.Close()
+		assert.NoError(t, afero.WriteFile(clientFs, "edited.txt", []byte("edited"), 0644))
+		err := c.SendFileDiffs(map[string]bool{"edited.txt": true})
+		assert.Error(t, err)
+		assert.True(t, sshsync.IsConnectionError(err))
+		assert.Equal(t, "original", c.FileCache["edited.txt"])
+		assert.NoError(t, clientFs.Remove("deleted.txt"))
+		assert.NoError(t, afero.WriteFile(clientFs, "created.txt", []byte("created"), 0644))
+
+		// everything that happened in between is sent after reconnecting
+		assert.NoError(t, c.Reconnect())
+		assert.Equal(t, 2, dials)
+		AssertFileContent(t, serverFs, "edited.txt", "edited")
+		AssertFileContent(t, serverFs, "created.txt", "created")
+		_, err = serverFs.Stat("deleted.txt")
+		assert.True(t, os.IsNotExist(err))
+		assert.NoError(t, c.AssertClientAndServerMatch())
+		c.Close()
+	})
+}
+
+// the connection drops while watching, and the edits made until it is back are
+// sent once dialing works again
+func TestClientServerWatchReconnect(t *testing.T) {
+	testName := "TestClientServerWatchReconnect"
+
+	WithClientServerFolders(t, testName, func(clientPath string, clientFs afero.Fs, serverFs afero.Fs) {
+		for _, path := range []string{"edited.txt", "deleted.txt"} {
+			assert.NoError(t, afero.WriteFile(serverFs, path, []byte("original"), 0644))
+			assert.NoError(t, afero.WriteFile(clientFs, path, []byte("original"), 0644))
+		}
+
+		var mu sync.Mutex
+		var serverConn io.ReadWriteCloser
+		dials := 0
+		failDial := false
+		c := &sshsync.ClientFolder{
+			BasePath:  clientPath,
+			ClientFs:  clientFs,
+			IgnoreCfg: sshsync.DefaultIgnoreConfig,
+			FileCache: make(map[string]string),
+		}
+		c.Dial = func() (io.ReadWriteCloser, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			dials++
+			if failDial {
+				failDial = false
+				return nil, errors.New("network is unreachable")
+			}
+			// a new server for every connection, like over ssh, the old one may
+			// still be waiting in PollChanges
+			server := sshsync.NewServerConfig(serverFs)
+			server.BuildCache()
+			var clientConn io.ReadWriteCloser
+			clientConn, serverConn = sshsync.TwoWayPipe()
+			go server.ReadCommands(serverConn)
+			return clientConn, nil
+		}
+		assert.NoError(t, c.Reconnect())
+		defer c.Close()
+		assert.NoError(t, c.StartWatchFiles(false))
+		defer c.StopWatchFiles()
+
+		// the transport drops, and the first dial after it fails too
+		mu.Lock()
+		failDial = true
+		serverConn.Close()
+		mu.Unlock()
+		assert.NoError(t, afero.WriteFile(clientFs, "edited.txt", []byte("edited"), 0644))
+		assert.NoError(t, afero.WriteFile(clientFs, "created.txt", []byte("created"), 0644))
+		assert.NoError(t, clientFs.Remove("deleted.txt"))
+
+		synced := func() bool {
+			edited, _ := afero.ReadFile(serverFs, "edited.txt")
+			created, _ := afero.ReadFile(serverFs, "created.txt")
+			_, err := serverFs.Stat("deleted.txt")
+			return string(edited) == "edited" && string(created) == "created" && os.IsNotExist(err)
+		}
+		deadline := time.Now().Add(10 * time.Second)
+		for !synced() && time.Now().Before(deadline) {
+			time.Sleep(50 * time.Millisecond)
+		}
+		AssertFileContent(t, serverFs, "edited.txt", "edited")
+		AssertFileContent(t, serverFs, "created.txt", "created")
+		_, err := serverFs.Stat("deleted.txt")
+		assert.True(t, os.IsNotExist(err))
+		mu.Lock()
+		// the first dial, the failed one and the one that worked
+		assert.Equal(t, 3, dials)
+		mu.Unlock()
+	})
+}
+
+func TestIsConnectionError(t *testing.T) {
+	assert.True(t, sshsync.IsConnectionError(rpc.ErrShutdown))
+	assert.True(t, sshsync.IsConnectionError(io.ErrUnexpectedEOF))
+	assert.True(t, sshsync.IsConnectionError(errors.Wrap(io.EOF, "read")))
+	assert.False(t, sshsync.IsConnectionError(rpc.ServerError("bad delta")))
+	assert.False(t, sshsync.IsConnectionError(nil))
+}
+
+func AssertFileMode(t *testing.T, fs afero.Fs, path string, mode os.FileMode) {
+	info, err := fs.Stat(path)
+	assert.NoError(t, err)
+	if err == nil {
+		assert.Equal(t, mode, info.Mode().Perm(), path)
+	}
+}
+
 // TODO test Client/server startup negotiation code
+
+func TestClientServerIgnoreConfig(t *testing.T) {
+	testName := "TestClientServerIgnoreConfig"
+	WithClientServerFolders(t, testName, func(clientPath string, clientFs afero.Fs, serverFs afero.Fs) {
+		for _, fs := range []afero.Fs{clientFs, serverFs} {
+			assert.NoError(t, afero.WriteFile(fs, "main.go", []byte("package main"), 0644))
+			assert.NoError(t, afero.WriteFile(fs, "notes.txt", []byte("notes"), 0644))
+			assert.NoError(t, afero.WriteFile(fs, "scratch.tmp", []byte("scratch"), 0644))
+		}
+		// the two sides disagree about what to ignore
+		assert.NoError(t, afero.WriteFile(serverFs, ".gitignore", []byte("*.txt\n"), 0644))
+		assert.NoError(t, afero.WriteFile(clientFs, sshsync.SyncIgnoreFile, []byte("*.tmp\n"), 0644))
+
+		server := sshsync.NewServerConfig(serverFs)
+		server.BuildCache()
+		clientConn, serverConn := sshsync.TwoWayPipe()
+		go server.ReadCommands(serverConn)
+		c := &sshsync.ClientFolder{
+			BasePath:  clientPath,
+			ClientFs:  clientFs,
+			IgnoreCfg: sshsync.DefaultIgnoreConfig,
+			FileCache: make(map[string]string),
+			Client:    rpc.NewClient(clientConn),
+		}
+		c.BuildCache()
+		assert.Error(t, c.AssertClientAndServerMatch())
+
+		assert.NoError(t, c.SendIgnoreConfig())
+		assert.NoError(t, c.AssertClientAndServerMatch())
+
+		c.Close()
+		serverConn.Close()
+	})
+
+	// like ServerMain, the cache is only built from the client's config
+	WithClientServerFolders(t, testName, func(clientPath string, clientFs afero.Fs, serverFs afero.Fs) {
+		for _, fs := range []afero.Fs{clientFs, serverFs} {
+			assert.NoError(t, afero.WriteFile(fs, "main.go", []byte("package main"), 0644))
+		}
+		server := sshsync.NewServerConfig(serverFs)
+		clientConn, serverConn := sshsync.TwoWayPipe()
+		go server.ReadCommands(serverConn)
+		c := &sshsync.ClientFolder{
+			BasePath:  clientPath,
+			ClientFs:  clientFs,
+			IgnoreCfg: sshsync.DefaultIgnoreConfig,
+			FileCache: make(map[string]string),
+			Client:    rpc.NewClient(clientConn),
+		}
+		c.BuildCache()
+		assert.NoError(t, c.Hello())
+		assert.NoError(t, c.SendIgnoreConfig())
+		_, _, match, _, err := c.CheckClientServerIndexes()
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"main.go"}, match)
+
+		c.Close()
+		serverConn.Close()
+	})
+}
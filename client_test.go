@@ -2,6 +2,7 @@ package sshsync_test
 
 import (
 	"fmt"
+	"hash/crc64"
 	"github.com/fsnotify/fsnotify"
 	"github.com/spf13/afero"
 	"os"
@@ -12,6 +13,8 @@ import (
 	"reflect"
 	"path/filepath"
 	"io"
+	"time"
+	"sync"
 )
 
 func WithFolder(t *testing.T, testName string, f func(absPath string, fs afero.Fs)) {
@@ -44,6 +47,8 @@ func TestClientSendFileDiffs(t *testing.T) {
 			ClientFs:  clientFs,
 			FileCache: make(map[string]string),
 			Client:    rpc.NewClient(clientConn),
+			// modification times are checked in TestClientSendModTime
+			TouchModTime: true,
 		}
 
 		err = c.BuildCache()
@@ -66,6 +71,9 @@ func TestClientSendFileDiffs(t *testing.T) {
 		// create new file
 		err = afero.WriteFile(clientFs, "newfile.txt", []byte("new\n\tcontent\n"), 0644)
 		assert.NoError(t, err)
+		// don't depend on umask
+		assert.NoError(t, clientFs.Chmod("testfile1.txt", 0644))
+		assert.NoError(t, clientFs.Chmod("newfile.txt", 0644))
 
 		err = c.SendFileDiffs(map[string]bool{
 			"testfile1.txt": true,
@@ -74,22 +82,519 @@ func TestClientSendFileDiffs(t *testing.T) {
 		assert.NoError(t, err)
 
 		result := server.CallsDelta[0]
-		expected2 := sshsync.TextFileDeltas{
-			{"newfile.txt", "+new%0A%09content%0A"},
-			{"testfile1.txt", "=5\t-1\t+2%0A"},
-		}
-		expected1 := sshsync.TextFileDeltas{
-			{"testfile1.txt", "=5\t-1\t+2%0A"},
-			{"newfile.txt", "+new%0A%09content%0A"},
-		}
+		meta := sshsync.FileMeta{Mode: 0644}
+		newDelta := sshsync.TextFileDelta{Path: "newfile.txt", Delta: "+new%0A%09content%0A",
+			BaseChecksum: crc64ecma(""), ResultChecksum: crc64ecma("new\n\tcontent\n"), FileMeta: meta}
+		changedDelta := sshsync.TextFileDelta{Path: "testfile1.txt", Delta: "=5\t-1\t+2%0A",
+			BaseChecksum: crc64ecma("test 1"), ResultChecksum: crc64ecma("test 2\n"), FileMeta: meta}
+		expected2 := sshsync.TextFileDeltas{newDelta, changedDelta}
+		expected1 := sshsync.TextFileDeltas{changedDelta, newDelta}
 		if !reflect.DeepEqual(result, expected1) && !reflect.DeepEqual(result, expected2) {
 			t.Log("len(result):", len(result))
 			t.Log("len(expected):", len(expected1))
-			t.Fatalf("%s should have been %s", result, expected1)
+			t.Fatalf("%v should have been %v", result, expected1)
+		}
+	})
+}
+
+func TestClientSendBinaryFileDiffs(t *testing.T) {
+	testName := "TestClientSendBinaryFileDiffs"
+	WithFolder(t, testName, func(clientPath string, clientFs afero.Fs) {
+		original := []byte{0, 1, 2, 3, 0xff}
+		changed := []byte{0, 1, 9, 3, 0xff}
+		assert.NoError(t, afero.WriteFile(clientFs, "data.bin", changed, 0644))
+		assert.NoError(t, afero.WriteFile(clientFs, "text.txt", []byte("text"), 0644))
+		assert.NoError(t, clientFs.Chmod("data.bin", 0600))
+		assert.NoError(t, clientFs.Chmod("text.txt", 0755))
+
+		clientConn, serverConn := sshsync.TwoWayPipe()
+		defer clientConn.Close()
+		defer serverConn.Close()
+		server := MockServer{}
+		go server.ReadCommands(serverConn)
+
+		c := &sshsync.ClientFolder{
+			BasePath: clientPath,
+			ClientFs: clientFs,
+			FileCache: map[string]string{
+				"data.bin": string(original),
+				"text.txt": "",
+			},
+			Client:       rpc.NewClient(clientConn),
+			TouchModTime: true,
 		}
+
+		err := c.SendFileDiffs(map[string]bool{
+			"data.bin": true,
+			"text.txt": true,
+		})
+		assert.NoError(t, err)
+
+		assert.Equal(t, sshsync.TextFileDeltas{
+			{Path: "text.txt", Delta: "+text", BaseChecksum: crc64ecma(""), ResultChecksum: crc64ecma("text"),
+				FileMeta: sshsync.FileMeta{Mode: 0755}},
+		}, server.CallsDelta[0])
+		assert.Equal(t, sshsync.BinaryFileDeltas{
+			{Path: "data.bin", Prefix: 2, Suffix: 2, Data: []byte{9},
+				BaseChecksum: crc64ecma(string(original)), ResultChecksum: crc64ecma(string(changed)),
+				FileMeta: sshsync.FileMeta{Mode: 0600}},
+		}, server.CallsBinaryDelta[0])
+		assert.Equal(t, string(changed), c.FileCache["data.bin"])
 	})
 }
 
+func TestClientSendFileDiffsPartialFailure(t *testing.T) {
+	testName := "TestClientSendFileDiffsPartialFailure"
+	WithFolder(t, testName, func(clientPath string, clientFs afero.Fs) {
+		old := map[string]string{
+			"text.txt": "old text",
+			"data.bin": string([]byte{0, 1, 2}),
+			"big.txt":  "old text that is sent with rsync",
+		}
+		memFs := afero.NewMemMapFs()
+		for path, content := range old {
+			assert.NoError(t, afero.WriteFile(memFs, path, []byte(content), 0644))
+		}
+		assert.NoError(t, afero.WriteFile(clientFs, "text.txt", []byte("new text"), 0644))
+		assert.NoError(t, afero.WriteFile(clientFs, "data.bin", []byte{0, 1, 9}, 0644))
+		assert.NoError(t, afero.WriteFile(clientFs, "big.txt", []byte("new text that is sent with rsync"), 0644))
+
+		// the rsync delta is written last, after the text and binary ones
+		serverFs := &failingFs{Fs: memFs, failPath: "big.txt"}
+		server := sshsync.NewServerConfig(serverFs)
+		server.BuildCache()
+		clientConn, serverConn := sshsync.TwoWayPipe()
+		defer clientConn.Close()
+		defer serverConn.Close()
+		go server.ReadCommands(serverConn)
+
+		c := &sshsync.ClientFolder{
+			BasePath:       clientPath,
+			ClientFs:       clientFs,
+			FileCache:      map[string]string{},
+			Client:         rpc.NewClient(clientConn),
+			RsyncThreshold: 20,
+		}
+		for path, content := range old {
+			c.FileCache[path] = content
+		}
+		files := map[string]bool{"text.txt": true, "data.bin": true, "big.txt": true}
+
+		// nothing is committed, on the server or in the cache
+		err := c.SendFileDiffs(files)
+		assert.Error(t, err)
+		for path, content := range old {
+			AssertFileContent(t, memFs, path, content)
+			assert.Equal(t, content, c.FileCache[path])
+		}
+
+		serverFs.failPath = ""
+		assert.NoError(t, c.SendFileDiffs(files))
+		for path := range old {
+			content, err := afero.ReadFile(clientFs, path)
+			assert.NoError(t, err)
+			AssertFileContent(t, memFs, path, string(content))
+			assert.Equal(t, string(content), c.FileCache[path])
+		}
+	})
+}
+
+func TestClientSendModTime(t *testing.T) {
+	testName := "TestClientSendModTime"
+	WithFolder(t, testName, func(clientPath string, clientFs afero.Fs) {
+		modTime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+		assert.NoError(t, afero.WriteFile(clientFs, "file.txt", []byte("new content"), 0644))
+		assert.NoError(t, clientFs.Chtimes("file.txt", modTime, modTime))
+
+		clientConn, serverConn := sshsync.TwoWayPipe()
+		defer clientConn.Close()
+		defer serverConn.Close()
+		server := MockServer{}
+		go server.ReadCommands(serverConn)
+
+		c := &sshsync.ClientFolder{
+			BasePath:  clientPath,
+			ClientFs:  clientFs,
+			FileCache: map[string]string{"file.txt": "old content"},
+			Client:    rpc.NewClient(clientConn),
+		}
+
+		err := c.SendFileDiffs(map[string]bool{"file.txt": true})
+		assert.NoError(t, err)
+		assert.True(t, modTime.Equal(server.CallsDelta[0][0].ModTime), server.CallsDelta[0][0].ModTime)
+
+		// touching sends no modification time, so the server uses the time of writing
+		c.TouchModTime = true
+		err = c.SendFileDiffs(map[string]bool{"file.txt": true})
+		assert.NoError(t, err)
+		assert.True(t, server.CallsDelta[1][0].ModTime.IsZero())
+	})
+}
+
+func TestClientResendRejectedDelta(t *testing.T) {
+	testName := "TestClientResendRejectedDelta"
+	WithFolder(t, testName, func(clientPath string, clientFs afero.Fs) {
+		assert.NoError(t, afero.WriteFile(clientFs, "drifted.txt", []byte("client content"), 0644))
+		assert.NoError(t, afero.WriteFile(clientFs, "fine.txt", []byte("fine content"), 0644))
+
+		clientConn, serverConn := sshsync.TwoWayPipe()
+		defer clientConn.Close()
+		defer serverConn.Close()
+		server := MockServer{RejectDelta: map[string]bool{"drifted.txt": true}}
+		go server.ReadCommands(serverConn)
+
+		c := &sshsync.ClientFolder{
+			BasePath:  clientPath,
+			ClientFs:  clientFs,
+			FileCache: map[string]string{"drifted.txt": "old", "fine.txt": "old"},
+			Client:    rpc.NewClient(clientConn),
+		}
+
+		err := c.SendFileDiffs(map[string]bool{"drifted.txt": true, "fine.txt": true})
+		assert.NoError(t, err)
+		// the commit is sent again, with only the rejected file whole
+		assert.Len(t, server.CallsCommit, 2)
+		if assert.Len(t, server.CallsDelta, 1) && assert.Len(t, server.CallsDelta[0], 1) {
+			assert.Equal(t, "fine.txt", server.CallsDelta[0][0].Path)
+		}
+		if assert.Len(t, server.CallsSendBinary, 1) && assert.Len(t, server.CallsSendBinary[0], 1) {
+			file := server.CallsSendBinary[0][0]
+			assert.Equal(t, "drifted.txt", file.Path)
+			assert.Equal(t, "client content", string(file.Content))
+		}
+		assert.Equal(t, "client content", c.FileCache["drifted.txt"])
+	})
+}
+
+func TestClientResendRejectedBinaryDelta(t *testing.T) {
+	testName := "TestClientResendRejectedBinaryDelta"
+	WithFolder(t, testName, func(clientPath string, clientFs afero.Fs) {
+		changed := []byte{0, 1, 9}
+		assert.NoError(t, afero.WriteFile(clientFs, "data.bin", changed, 0644))
+
+		clientConn, serverConn := sshsync.TwoWayPipe()
+		defer clientConn.Close()
+		defer serverConn.Close()
+		server := MockServer{RejectDelta: map[string]bool{"data.bin": true}}
+		go server.ReadCommands(serverConn)
+
+		c := &sshsync.ClientFolder{
+			BasePath:     clientPath,
+			ClientFs:     clientFs,
+			FileCache:    map[string]string{"data.bin": string([]byte{0, 1, 2})},
+			Client:       rpc.NewClient(clientConn),
+			TouchModTime: true,
+		}
+
+		err := c.SendFileDiffs(map[string]bool{"data.bin": true})
+		assert.NoError(t, err)
+		assert.Len(t, server.CallsCommit, 2)
+		assert.Len(t, server.CallsBinaryDelta, 0)
+		assert.Equal(t, [][]sshsync.BinaryFile{
+			{{Path: "data.bin", Content: changed, FileMeta: sshsync.FileMeta{Mode: 0644}}},
+		}, server.CallsSendBinary)
+		assert.Equal(t, string(changed), c.FileCache["data.bin"])
+	})
+}
+
+func TestClientApplyServerChanges(t *testing.T) {
+	testName := "TestClientApplyServerChanges"
+	WithFolder(t, testName, func(clientPath string, clientFs afero.Fs) {
+		assert.NoError(t, afero.WriteFile(clientFs, "deleted.txt", []byte("deleted"), 0644))
+
+		clientConn, serverConn := sshsync.TwoWayPipe()
+		defer clientConn.Close()
+		defer serverConn.Close()
+		server := MockServer{ServerChanges: make(chan []sshsync.FileChange)}
+		go server.ReadCommands(serverConn)
+
+		c := &sshsync.ClientFolder{
+			BasePath:  clientPath,
+			ClientFs:  clientFs,
+			IgnoreCfg: sshsync.DefaultIgnoreConfig,
+			FileCache: make(map[string]string),
+			Client:    rpc.NewClient(clientConn),
+		}
+		assert.NoError(t, c.BuildCache())
+		assert.NoError(t, c.StartWatchFiles(false))
+		defer c.StopWatchFiles()
+
+		server.ServerChanges <- []sshsync.FileChange{
+			{TextFile: sshsync.TextFile{Path: "generated/file.txt", Content: "generated", FileMeta: sshsync.FileMeta{Mode: 0755}}},
+			{TextFile: sshsync.TextFile{Path: "deleted.txt"}, Deleted: true},
+		}
+
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			if _, err := clientFs.Stat("deleted.txt"); os.IsNotExist(err) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		AssertFileContent(t, clientFs, "generated/file.txt", "generated")
+		AssertFileMode(t, clientFs, "generated/file.txt", 0755)
+		_, err := clientFs.Stat("deleted.txt")
+		assert.True(t, os.IsNotExist(err))
+	})
+}
+
+func TestClientMergeServerChange(t *testing.T) {
+	testName := "TestClientMergeServerChange"
+	WithFolder(t, testName, func(clientPath string, clientFs afero.Fs) {
+		assert.NoError(t, afero.WriteFile(clientFs, "file.txt", []byte("a\nb\nc\n"), 0644))
+
+		clientConn, serverConn := sshsync.TwoWayPipe()
+		defer clientConn.Close()
+		defer serverConn.Close()
+		server := MockServer{ServerChanges: make(chan []sshsync.FileChange)}
+		go server.ReadCommands(serverConn)
+
+		c := &sshsync.ClientFolder{
+			BasePath:       clientPath,
+			ClientFs:       clientFs,
+			IgnoreCfg:      sshsync.DefaultIgnoreConfig,
+			FileCache:      make(map[string]string),
+			Client:         rpc.NewClient(clientConn),
+			BaseFs:         afero.NewMemMapFs(),
+			ConflictPolicy: sshsync.ConflictMerge,
+		}
+		assert.NoError(t, c.BuildCache())
+		assert.NoError(t, c.StartWatchFiles(false))
+		defer c.StopWatchFiles()
+
+		// the server's edit comes in before the local one is sent
+		assert.NoError(t, afero.WriteFile(clientFs, "file.txt", []byte("A\nb\nc\n"), 0644))
+		time.Sleep(50 * time.Millisecond)
+		server.ServerChanges <- []sshsync.FileChange{
+			{TextFile: sshsync.TextFile{Path: "file.txt", Content: "a\nb\nC\n"}},
+		}
+
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+			server.mu.Lock()
+			sent := len(server.CallsDelta) > 0
+			server.mu.Unlock()
+			if sent {
+				break
+			}
+		}
+		AssertFileContent(t, clientFs, "file.txt", "A\nb\nC\n")
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		if assert.Len(t, server.CallsDelta, 1) && assert.Len(t, server.CallsDelta[0], 1) {
+			// made against the server's version, and keeps its edit
+			delta := server.CallsDelta[0][0]
+			assert.Equal(t, crc64ecma("a\nb\nC\n"), delta.BaseChecksum)
+			assert.Equal(t, crc64ecma("A\nb\nC\n"), delta.ResultChecksum)
+		}
+	})
+}
+
+func TestClientManualServerChangeNotSynced(t *testing.T) {
+	testName := "TestClientManualServerChangeNotSynced"
+	WithFolder(t, testName, func(clientPath string, clientFs afero.Fs) {
+		assert.NoError(t, afero.WriteFile(clientFs, "file.txt", []byte("old"), 0644))
+
+		clientConn, serverConn := sshsync.TwoWayPipe()
+		defer clientConn.Close()
+		defer serverConn.Close()
+		server := MockServer{ServerChanges: make(chan []sshsync.FileChange)}
+		go server.ReadCommands(serverConn)
+
+		c := &sshsync.ClientFolder{
+			BasePath:       clientPath,
+			ClientFs:       clientFs,
+			IgnoreCfg:      sshsync.DefaultIgnoreConfig,
+			FileCache:      make(map[string]string),
+			Client:         rpc.NewClient(clientConn),
+			BaseFs:         afero.NewMemMapFs(),
+			ConflictPolicy: sshsync.ConflictManual,
+		}
+		assert.NoError(t, c.BuildCache())
+		assert.NoError(t, c.StartWatchFiles(false))
+		defer c.StopWatchFiles()
+
+		// the server's edit comes in before the local one is sent
+		assert.NoError(t, afero.WriteFile(clientFs, "file.txt", []byte("client"), 0644))
+		time.Sleep(50 * time.Millisecond)
+		server.ServerChanges <- []sshsync.FileChange{
+			{TextFile: sshsync.TextFile{Path: "file.txt", Content: "server"}},
+		}
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			if _, err := clientFs.Stat("file.txt.sshsync-server"); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		AssertFileContent(t, clientFs, "file.txt.sshsync-server", "server")
+
+		// saving again sends the local version, and never the conflict copy
+		assert.NoError(t, afero.WriteFile(clientFs, "file.txt", []byte("client again"), 0644))
+		deadline = time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+			server.mu.Lock()
+			sent := len(server.CallsDelta) > 0
+			server.mu.Unlock()
+			if sent {
+				break
+			}
+		}
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		assert.NotEmpty(t, server.CallsCommit)
+		for _, commit := range server.CallsCommit {
+			for _, delta := range commit.TextDeltas {
+				assert.Equal(t, "file.txt", delta.Path)
+			}
+			assert.Empty(t, commit.Files)
+		}
+	})
+}
+
+func TestClientSendFileDeletes(t *testing.T) {
+	testName := "TestClientSendFileDeletes"
+	WithFolder(t, testName, func(clientPath string, clientFs afero.Fs) {
+		clientConn, serverConn := sshsync.TwoWayPipe()
+		defer clientConn.Close()
+		defer serverConn.Close()
+		server := MockServer{}
+		go server.ReadCommands(serverConn)
+
+		c := &sshsync.ClientFolder{
+			BasePath: clientPath,
+			ClientFs: clientFs,
+			FileCache: map[string]string{
+				"deleted.txt":        "deleted",
+				"folder/deleted.txt": "deleted",
+				"folder/nested.txt":  "deleted",
+				"kept.txt":           "kept",
+			},
+			Client: rpc.NewClient(clientConn),
+		}
+
+		// nothing to delete does not call the server
+		err := c.SendFileDeletes(map[string]bool{})
+		assert.NoError(t, err)
+		assert.Len(t, server.CallsDeleteFiles, 0)
+
+		err = c.SendFileDeletes(map[string]bool{
+			"deleted.txt":        true,
+			"folder/deleted.txt": true,
+			"folder/nested.txt":  true,
+		})
+		assert.NoError(t, err)
+
+		assert.Len(t, server.CallsDeleteFiles, 1)
+		assert.ElementsMatch(t, []string{"deleted.txt", "folder/deleted.txt", "folder/nested.txt"}, server.CallsDeleteFiles[0])
+		assert.Equal(t, map[string]string{"kept.txt": "kept"}, c.FileCache)
+	})
+}
+
+func TestClientWatchRename(t *testing.T) {
+	testName := "TestClientWatchRename"
+	WithFolder(t, testName, func(clientPath string, clientFs afero.Fs) {
+		assert.NoError(t, afero.WriteFile(clientFs, "old.txt", []byte("content"), 0644))
+		assert.NoError(t, clientFs.Mkdir("olddir", 0755))
+		assert.NoError(t, afero.WriteFile(clientFs, "olddir/nested.txt", []byte("nested"), 0644))
+
+		clientConn, serverConn := sshsync.TwoWayPipe()
+		defer clientConn.Close()
+		defer serverConn.Close()
+		server := MockServer{}
+		go server.ReadCommands(serverConn)
+
+		c := &sshsync.ClientFolder{
+			BasePath:  clientPath,
+			ClientFs:  clientFs,
+			IgnoreCfg: sshsync.DefaultIgnoreConfig,
+			FileCache: make(map[string]string),
+			Client:    rpc.NewClient(clientConn),
+		}
+		assert.NoError(t, c.BuildCache())
+		assert.NoError(t, c.StartWatchFiles(false))
+		defer c.StopWatchFiles()
+
+		assert.NoError(t, clientFs.Rename("old.txt", "new.txt"))
+		assert.NoError(t, clientFs.Rename("olddir", "newdir"))
+
+		// renames may be split across commits
+		renames := sshsync.FileRenames{}
+		deadline := time.Now().Add(2 * time.Second)
+		for len(renames) < 2 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+			renames = sshsync.FileRenames{}
+			server.mu.Lock()
+			for _, call := range server.CallsRename {
+				renames = append(renames, call...)
+			}
+			server.mu.Unlock()
+		}
+		assert.ElementsMatch(t, sshsync.FileRenames{
+			{OldPath: "old.txt", NewPath: "new.txt"},
+			{OldPath: "olddir", NewPath: "newdir"},
+		}, renames)
+		// nothing was deleted
+		assert.Len(t, server.CallsDeleteFiles, 0)
+	})
+}
+
+func TestClientWatchSaveByRename(t *testing.T) {
+	testName := "TestClientWatchSaveByRename"
+	WithFolder(t, testName, func(clientPath string, clientFs afero.Fs) {
+		assert.NoError(t, afero.WriteFile(clientFs, "foo.txt", []byte("old content"), 0644))
+
+		clientConn, serverConn := sshsync.TwoWayPipe()
+		defer clientConn.Close()
+		defer serverConn.Close()
+		server := MockServer{}
+		go server.ReadCommands(serverConn)
+
+		c := &sshsync.ClientFolder{
+			BasePath:  clientPath,
+			ClientFs:  clientFs,
+			IgnoreCfg: sshsync.DefaultIgnoreConfig,
+			FileCache: make(map[string]string),
+			Client:    rpc.NewClient(clientConn),
+		}
+		assert.NoError(t, c.BuildCache())
+		assert.NoError(t, c.StartWatchFiles(false))
+		defer c.StopWatchFiles()
+
+		// like vim: the old file becomes an ignored backup and the new one is written
+		assert.NoError(t, clientFs.Rename("foo.txt", ".foo.txt~"))
+		// the rename is seen before the new file is there, but in the same commit
+		time.Sleep(50 * time.Millisecond)
+		assert.NoError(t, afero.WriteFile(clientFs, "foo.txt", []byte("new content"), 0644))
+
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+			server.mu.Lock()
+			sent := len(server.CallsDelta) > 0
+			server.mu.Unlock()
+			if sent {
+				break
+			}
+		}
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		assert.Len(t, server.CallsDeleteFiles, 0)
+		if assert.Len(t, server.CallsDelta, 1) && assert.Len(t, server.CallsDelta[0], 1) {
+			assert.Equal(t, "foo.txt", server.CallsDelta[0][0].Path)
+			assert.Equal(t, crc64ecma("new content"), server.CallsDelta[0][0].ResultChecksum)
+		}
+	})
+}
+
+var ecmaTable = crc64.MakeTable(crc64.ECMA)
+
+func crc64ecma(content string) uint64 {
+	return crc64.Checksum([]byte(content), ecmaTable)
+}
+
 func AssertFileContent(t *testing.T, fs afero.Fs, path string, content string) {
 	fileBytes, err := afero.ReadFile(fs, path)
 	assert.NoError(t, err)
@@ -97,35 +602,143 @@ func AssertFileContent(t *testing.T, fs afero.Fs, path string, content string) {
 }
 
 type MockServer struct {
-	CallsDelta          []sshsync.TextFileDeltas
-	FileHashes          sshsync.ChecksumIndex
+	CallsDelta []sshsync.TextFileDeltas
+	// paths whose deltas are rejected, as if the server's copy had drifted
+	RejectDelta         map[string]bool
+	CallsSendTextFiles  [][]sshsync.TextFile
+	FileHashes          sshsync.FileIndex
 	CallsGetTextFile    []string
 	ResponseGetTextFile map[string]string
 	CallsSendTextFile   []sshsync.TextFile
-	server    *rpc.Server
+	CallsDeleteFiles    [][]string
+	CallsRename         []sshsync.FileRenames
+	CallsBinaryDelta    []sshsync.BinaryFileDeltas
+	CallsSendBinary     [][]sshsync.BinaryFile
+	CallsCommit         []sshsync.Commit
+	ServerChanges       chan []sshsync.FileChange
+	server              *rpc.Server
+	// calls can come in while a test is looking at them
+	mu sync.Mutex
 }
 
-func (c *MockServer) Delta(deltas sshsync.TextFileDeltas, _ *int) error {
+func (c *MockServer) Delta(deltas sshsync.TextFileDeltas, rejected *[]string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.CallsDelta = append(c.CallsDelta, deltas)
+	*rejected = []string{}
+	for _, delta := range deltas {
+		if c.RejectDelta[delta.Path] {
+			*rejected = append(*rejected, delta.Path)
+		}
+	}
 	return nil
 }
 
-func (c *MockServer) GetFileHashes(_ int, index *sshsync.ChecksumIndex) error {
+func (c *MockServer) GetFileHashes(_ sshsync.FileIndexRequest, index *sshsync.FileIndex) error {
 	*index = c.FileHashes
 	return nil
 }
 
 func (c *MockServer) GetTextFile(path string, content *string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.CallsGetTextFile = append(c.CallsGetTextFile, path)
 	*content = c.ResponseGetTextFile[path]
 	return nil
 }
 
 func (c *MockServer) SendTextFile(file sshsync.TextFile, _ *int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.CallsSendTextFile = append(c.CallsSendTextFile, file)
 	return nil
 }
 
+func (c *MockServer) SendTextFiles(files []sshsync.TextFile, _ *int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.CallsSendTextFiles = append(c.CallsSendTextFiles, files)
+	return nil
+}
+
+func (c *MockServer) DeleteFiles(paths []string, _ *int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.CallsDeleteFiles = append(c.CallsDeleteFiles, paths)
+	return nil
+}
+
+func (c *MockServer) Rename(renames sshsync.FileRenames, _ *int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.CallsRename = append(c.CallsRename, renames)
+	return nil
+}
+
+func (c *MockServer) BinaryDelta(deltas sshsync.BinaryFileDeltas, rejected *[]string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.CallsBinaryDelta = append(c.CallsBinaryDelta, deltas)
+	*rejected = []string{}
+	for _, delta := range deltas {
+		if c.RejectDelta[delta.Path] {
+			*rejected = append(*rejected, delta.Path)
+		}
+	}
+	return nil
+}
+
+// a commit that goes through is also recorded with the calls for each of its
+// parts, so that tests can look at what was sent however it was sent
+func (c *MockServer) Commit(commit sshsync.Commit, rejected *[]string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.CallsCommit = append(c.CallsCommit, commit)
+	*rejected = []string{}
+	for _, delta := range commit.TextDeltas {
+		if c.RejectDelta[delta.Path] {
+			*rejected = append(*rejected, delta.Path)
+		}
+	}
+	for _, delta := range commit.BinaryDeltas {
+		if c.RejectDelta[delta.Path] {
+			*rejected = append(*rejected, delta.Path)
+		}
+	}
+	if len(*rejected) > 0 {
+		return nil
+	}
+	if len(commit.Renames) > 0 {
+		c.CallsRename = append(c.CallsRename, commit.Renames)
+	}
+	if len(commit.TextDeltas) > 0 {
+		c.CallsDelta = append(c.CallsDelta, commit.TextDeltas)
+	}
+	if len(commit.BinaryDeltas) > 0 {
+		c.CallsBinaryDelta = append(c.CallsBinaryDelta, commit.BinaryDeltas)
+	}
+	if len(commit.Files) > 0 {
+		c.CallsSendBinary = append(c.CallsSendBinary, commit.Files)
+	}
+	if len(commit.Deletes) > 0 {
+		c.CallsDeleteFiles = append(c.CallsDeleteFiles, commit.Deletes)
+	}
+	return nil
+}
+
+func (c *MockServer) SendBinaryFiles(files []sshsync.BinaryFile, _ *int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.CallsSendBinary = append(c.CallsSendBinary, files)
+	return nil
+}
+
+// blocks forever if there is no channel
+func (c *MockServer) PollChanges(_ int, changes *[]sshsync.FileChange) error {
+	*changes = <-c.ServerChanges
+	return nil
+}
+
 func (c *MockServer) ReadCommands(conn io.ReadWriteCloser) {
 	c.server = rpc.NewServer()
 	c.server.RegisterName("Server", c)
@@ -11,8 +11,9 @@ import (
 	"io"
 	"os"
 	"golang.org/x/crypto/ssh"
+	"github.com/pkg/errors"
 	"os/exec"
-	"io/ioutil"
+	"time"
 )
 
 // protocol constants
@@ -42,32 +43,34 @@ const (
 	EnvIgnoreCfg = "LC_SSHSYNC_IGNORE_CFG"
 
 	BinName = "sshsync"
+	// the server binary has to be the same version as the client
+	Version = "0.2.0"
 )
 
-// TODO serialize this so it can go in env
+// the client sends its own to the server with SetIgnoreConfig, so both sides agree
+// on which files exist
 type IgnoreConfig struct {
+	// if not empty, only files with these extensions are synced
 	Extensions []string
 	// glob matched
 	GlobIgnore         []string
 	compiledGlobIgnore []glob.Glob
+	// files bigger than this are not synced, 0 for no limit
+	MaxFileSize int64
+	// .gitignore files are followed unless this is set, see gitignore.go
+	NoGitIgnore bool
+	// contents of the ignore files by path, read from disk when nil, see Snapshot
+	IgnoreFiles    map[string]string
+	gitIgnoreCache *gitIgnoreCache
 }
 
+// binary files are detected and sent as raw bytes, so no extension whitelist is needed
 var DefaultIgnoreConfig = IgnoreConfig{
-	Extensions: []string{
-		".cpp",
-		".hpp",
-		".c",
-		".h",
-		".go",
-		".hs",
-		".cl",
-		".js",
-		".md",
-		".txt",
-	},
 	GlobIgnore: []string{
 		// ignore all hidden files and folders
 		".*",
+		// written by the server while it runs
+		"server.log",
 		// ignore build folders
 		"build/*",
 		"target/*",
@@ -91,32 +94,27 @@ func (cfg *IgnoreConfig) compileGlobs() {
 	}
 }
 
-func (cfg *IgnoreConfig) ShouldIgnore(fs afero.Fs, path string) bool {
-	// if zero-initialized, ignore only what can't be stat
-	if len(cfg.Extensions) == 0 &&
-		len(cfg.GlobIgnore) == 0 &&
-		len(cfg.compiledGlobIgnore) == 0 {
-		log.Println("default not ignoring", path)
-		stat, err := fs.Stat(path)
-		if err != nil && stat.IsDir() {
-			log.Println("default ignoring dir", path)
-			return true
-		} else if err != nil && !stat.IsDir() {
-			log.Println("default not ignoring", path)
-			return false
-		} else {
-			log.Println("default ignoring non existent", path)
-			return false
-		}
-	}
-
+// whether path matches any of the ignore globs, without logging
+func (cfg *IgnoreConfig) matchesGlob(path string) bool {
 	cfg.compileGlobs()
 	for _, globIgnore := range cfg.compiledGlobIgnore {
 		if globIgnore.Match(path) {
-			log.Println("ignoring", path)
 			return true
 		}
 	}
+	return false
+}
+
+func (cfg *IgnoreConfig) ShouldIgnore(fs afero.Fs, path string) bool {
+	if strings.HasSuffix(path, conflictCopySuffix) {
+		// the server's side of a conflict, only for the user to look at
+		log.Println("ignoring conflict copy", path)
+		return true
+	}
+	if cfg.matchesGlob(path) {
+		log.Println("ignoring", path)
+		return true
+	}
 
 	info, err := fs.Stat(path)
 	if err == nil && info.IsDir() {
@@ -129,6 +127,20 @@ func (cfg *IgnoreConfig) ShouldIgnore(fs afero.Fs, path string) bool {
 		return true
 	}
 
+	if cfg.MaxFileSize > 0 && info.Size() > cfg.MaxFileSize {
+		log.Println("ignoring too big", path)
+		return true
+	}
+
+	if cfg.gitIgnored(fs, path, false) {
+		log.Println("ignoring by gitignore", path)
+		return true
+	}
+
+	if len(cfg.Extensions) == 0 {
+		log.Println("not ignoring", path)
+		return false
+	}
 	// do not ignore whitelisted extensions
 	for _, extension := range cfg.Extensions {
 		if strings.HasSuffix(path, extension) {
@@ -164,61 +176,115 @@ func crc64string(content string) string {
 
 /////////////////////////////////////////////////////////
 
-func makeSigner(keyname string) (signer ssh.Signer, err error) {
-	fp, err := os.Open(keyname)
-	if err != nil {
-		return
-	}
-	defer fp.Close()
+// one ssh server to log in to, either the sync server or a jump host on the way
+type SshHop struct {
+	User     string
+	Address  string
+	Auth     *SshAuth
+	HostKeys *HostKeyVerifier
+}
 
-	buf, err := ioutil.ReadAll(fp)
-	if err != nil {
-		return nil, err
+// hop for a host from the ssh config, with the default user and keys where it has none
+func NewSshHop(host SshHost, hostKeys *HostKeyVerifier) SshHop {
+	hop := SshHop{
+		User:     host.User,
+		Address:  host.Address(),
+		Auth:     NewSshAuth(),
+		HostKeys: hostKeys,
 	}
-	signer, err = ssh.ParsePrivateKey(buf)
-	if err != nil {
-		return nil, err
+	if hop.User == "" {
+		hop.User = os.Getenv("USER")
 	}
-	return
-}
-func makeKeyring() []ssh.AuthMethod {
-	signers := []ssh.Signer{}
-	keys := []string{
-		os.Getenv("HOME") + "/.ssh/id_rsa",
-		os.Getenv("HOME") + "/.ssh/id_dsa",
-		os.Getenv("HOME") + "/.ssh/id_ecdsa",
-		os.Getenv("HOME") + "/.ssh/id_ed25519",
+	if len(host.IdentityFiles) > 0 {
+		hop.Auth.KeyFiles = host.KeyFiles()
 	}
+	return hop
+}
 
-	for _, keyname := range keys {
-		signer, err := makeSigner(keyname)
-		if err == nil {
-			signers = append(signers, signer)
-		}
+func (h SshHop) clientConfig() *ssh.ClientConfig {
+	return &ssh.ClientConfig{
+		User:              h.User,
+		Auth:              h.Auth.AuthMethods(),
+		HostKeyCallback:   h.HostKeys.HostKeyCallback(),
+		HostKeyAlgorithms: h.HostKeys.HostKeyAlgorithms(h.Address),
 	}
+}
+
+// the connection to the server, and the ones to the jump hosts it goes through
+type SshClient struct {
+	*ssh.Client
+	// in the order they were dialed
+	jumps []*ssh.Client
+}
 
-	return []ssh.AuthMethod{ssh.PublicKeys(signers...)}
+// closes the connection to the server, then the jump hosts from the last to the first
+func (c *SshClient) Close() error {
+	err := c.Client.Close()
+	closeAll(c.jumps)
+	return err
 }
-func OpenSshConnection(serverSidePath, user, address string) (io.ReadWriteCloser, error) {
-	config := &ssh.ClientConfig{
-		User:            user,
-		Auth:            makeKeyring(),
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+
+func closeAll(clients []*ssh.Client) {
+	for i := len(clients) - 1; i >= 0; i-- {
+		clients[i].Close()
 	}
+}
 
-	// FIXME: conn and session are leaked
-	// probably not a problem in this use-case because we would close these connections right before exiting
-	// the program anyway
+// logs in to every jump host in order, and then to server through a direct-tcpip
+// channel from the last one, like ssh -J
+func DialSsh(server SshHop, jumps []SshHop) (*SshClient, error) {
+	hops := append(append([]SshHop{}, jumps...), server)
+	clients := []*ssh.Client{}
+	for _, hop := range hops {
+		if len(clients) == 0 {
+			client, err := ssh.Dial("tcp", hop.Address, hop.clientConfig())
+			if err != nil {
+				return nil, errors.Wrap(err, "dial "+hop.Address)
+			}
+			clients = append(clients, client)
+			continue
+		}
 
-	conn, err := ssh.Dial("tcp", address, config)
+		tunnel, err := clients[len(clients)-1].Dial("tcp", hop.Address)
+		if err != nil {
+			closeAll(clients)
+			return nil, errors.Wrap(err, "tunnel to "+hop.Address)
+		}
+		conn, chans, reqs, err := ssh.NewClientConn(tunnel, hop.Address, hop.clientConfig())
+		if err != nil {
+			tunnel.Close()
+			closeAll(clients)
+			return nil, errors.Wrap(err, "dial "+hop.Address)
+		}
+		clients = append(clients, ssh.NewClient(conn, chans, reqs))
+	}
+	last := len(clients) - 1
+	return &SshClient{Client: clients[last], jumps: clients[:last]}, nil
+}
+
+// serverCommand is how to start sshsync on the server, "" to find or upload it
+func OpenSshConnection(serverSidePath, serverCommand string, server SshHop, jumps []SshHop, keepAlive KeepAliveConfig) (io.ReadWriteCloser, error) {
+	conn, err := DialSsh(server, jumps)
 	if err != nil {
 		log.Println("dial", err)
 		return nil, err
 	}
+	StartKeepAlive(conn.Client, keepAlive)
+
+	if serverCommand == "" {
+		deployer := &Deployer{Run: SshRunner(conn.Client)}
+		serverCommand, err = deployer.Deploy()
+		if err != nil {
+			log.Println("deploy server", err)
+			conn.Close()
+			return nil, err
+		}
+	}
 
 	session, err := conn.NewSession()
 	if err != nil {
 		log.Println("create session", err)
+		conn.Close()
 		return nil, err
 	}
 
@@ -230,27 +296,44 @@ func OpenSshConnection(serverSidePath, user, address string) (io.ReadWriteCloser
 	stdin, err := session.StdinPipe()
 	if err != nil {
 		log.Println("stdin pipe", err)
+		conn.Close()
 		return nil, err
 	}
 	stdout, err := session.StdoutPipe()
 	if err != nil {
 		log.Println("stdout pipe", err)
+		conn.Close()
 		return nil, err
 	}
 	fmt.Println("stdin, stdout", stdin, stdout)
 
-	err = session.Start(BinName + " -server")
+	err = session.Start(serverCommand + " -server")
 	if err != nil {
 		log.Println("start cmd", err)
+		conn.Close()
 		return nil, err
 	}
 
 	_, err = fmt.Fprintln(stdin, serverSidePath)
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 
-	return &ReadWriteCloseAdapter{stdout, stdin}, nil
+	return &sshConnection{ReadWriteCloseAdapter{stdout, stdin}, conn}, nil
+}
+
+// closing the connection to the server closes the ssh connections as well,
+// including the ones to the jump hosts, so nothing is left over after reconnecting
+type sshConnection struct {
+	ReadWriteCloseAdapter
+	client *SshClient
+}
+
+func (s *sshConnection) Close() error {
+	err := s.ReadWriteCloseAdapter.Close()
+	s.client.Close()
+	return err
 }
 
 func OpenLocalConnection(path string) (io.ReadWriteCloser, error) {
@@ -281,20 +364,108 @@ func (s *ReadWriteCloseAdapter) Write(p []byte) (n int, err error) { return s.Wr
 func (s *ReadWriteCloseAdapter) Close() error                      { return s.Writer.Close() }
 func (s *ReadWriteCloseAdapter) Read(p []byte) (n int, err error)  { return s.Reader.Read(p) }
 
+// metadata sent along with file content
+type FileMeta struct {
+	// permission bits, 0 if unknown
+	Mode os.FileMode
+	// zero to leave the file with the time it was written at
+	ModTime time.Time
+}
+
+func statFileMeta(fs afero.Fs, path string) FileMeta {
+	info, err := fs.Stat(path)
+	if err != nil {
+		return FileMeta{}
+	}
+	return FileMeta{
+		Mode:    info.Mode().Perm(),
+		ModTime: info.ModTime(),
+	}
+}
+
 type TextFile struct {
 	Path    string
 	Content string
+	FileMeta
 }
 
-// map of Path to Crc64
-type ChecksumIndex map[string]uint64
+// map of Path to permission bits
+type FileModeIndex map[string]os.FileMode
 
 type TextFileDelta struct {
 	Path  string
 	Delta string
+	// crc64 of the text the delta was made against and of the text it makes,
+	// so that a delta is never applied to a cache that drifted from the client's
+	BaseChecksum   uint64
+	ResultChecksum uint64
+	FileMeta
 }
 type TextFileDeltas []TextFileDelta
 
+// a delta from oldText to newText, with the checksums the server checks it against
+func MakeTextDelta(path, oldText, newText string) TextFileDelta {
+	return TextFileDelta{
+		Path:           path,
+		Delta:          dmp.DiffToDelta(dmp.DiffMain(oldText, newText, false)),
+		BaseChecksum:   crc64checksum(oldText),
+		ResultChecksum: crc64checksum(newText),
+	}
+}
+
+// an edit made on the server, sent back to the client
+type FileChange struct {
+	TextFile
+	Deleted bool
+}
+
+// a file or folder that moved without its content changing
+type FileRename struct {
+	OldPath string
+	NewPath string
+}
+type FileRenames []FileRename
+
+// everything saved together on the client, applied by the server all together
+// or not at all
+type Commit struct {
+	Renames      FileRenames
+	TextDeltas   TextFileDeltas
+	BinaryDeltas BinaryFileDeltas
+	RsyncDeltas  RsyncDeltas
+	// whole files, for the paths whose deltas the server rejected
+	Files   []BinaryFile
+	Deletes []string
+}
+
+// whether path is root, or inside of root if it is a folder
+func inPath(path, root string) bool {
+	return path == root || strings.HasPrefix(path, root+"/")
+}
+
+// replaces the oldPath prefix of path with newPath
+// ok is false if path is not in oldPath
+func renamedPath(path, oldPath, newPath string) (string, bool) {
+	if !inPath(path, oldPath) {
+		return "", false
+	}
+	return newPath + strings.TrimPrefix(path, oldPath), true
+}
+
+// moves every cache entry at or below oldPath to newPath
+func renameCacheEntries(cache map[string]string, oldPath, newPath string) {
+	moved := make(map[string]string)
+	for path, content := range cache {
+		if renamed, ok := renamedPath(path, oldPath, newPath); ok {
+			delete(cache, path)
+			moved[renamed] = content
+		}
+	}
+	for path, content := range moved {
+		cache[path] = content
+	}
+}
+
 func TwoWayPipe() (io.ReadWriteCloser, io.ReadWriteCloser) {
 	// server read, Client write (and vice versa)
 	sr, cw := io.Pipe()
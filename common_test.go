@@ -5,6 +5,13 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/spf13/afero"
 	"github.com/Joshua-Wright/sshsync"
+	"encoding/pem"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
 )
 
 func TestIgnoreConfig_ShouldIgnore(t *testing.T) {
@@ -29,3 +36,87 @@ func TestIgnoreConfig_ShouldIgnore(t *testing.T) {
 	assert.False(t, ignore1.ShouldIgnore(fs, "important file.txt"))
 	assert.False(t, ignore1.ShouldIgnore(fs, "the.test"))
 }
+
+func TestIgnoreConfig_ShouldIgnoreAnyExtension(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	cfg := &sshsync.IgnoreConfig{
+		GlobIgnore: []string{".*"},
+	}
+
+	fs.Mkdir("folder", 0755)
+	afero.WriteFile(fs, "image.png", []byte{0x89, 'P', 'N', 'G'}, 0644)
+	afero.WriteFile(fs, "Makefile", []byte{}, 0644)
+	afero.WriteFile(fs, ".hidden", []byte{}, 0644)
+
+	assert.False(t, cfg.ShouldIgnore(fs, "image.png"))
+	assert.False(t, cfg.ShouldIgnore(fs, "Makefile"))
+	assert.True(t, cfg.ShouldIgnore(fs, ".hidden"))
+	assert.True(t, cfg.ShouldIgnore(fs, "folder"))
+	assert.True(t, cfg.ShouldIgnore(fs, "does not exist.png"))
+}
+
+func TestDialSshJumpHosts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestDialSshJumpHosts")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// every server wants its own key
+	servers := []*testSshServer{}
+	hops := []sshsync.SshHop{}
+	knownHostsFile := filepath.Join(dir, "known_hosts")
+	verifier := sshsync.NewHostKeyVerifier(sshsync.HostKeyStrict, knownHostsFile)
+	for _, name := range []string{"bastion", "inner", "server"} {
+		priv, pub := newUserKey(t)
+		block, err := ssh.MarshalPrivateKey(priv, "")
+		assert.NoError(t, err)
+		keyFile := filepath.Join(dir, name)
+		assert.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(block), 0600))
+
+		server := startSshServer(t, pub)
+		defer server.Stop()
+		servers = append(servers, server)
+		hops = append(hops, sshsync.SshHop{
+			User:     "user",
+			Address:  server.Address,
+			Auth:     &sshsync.SshAuth{AgentSocket: filepath.Join(dir, "missing.sock"), KeyFiles: []string{keyFile}},
+			HostKeys: verifier,
+		})
+	}
+
+	// the last host is not known yet
+	knownHosts := ""
+	for _, server := range servers[:2] {
+		knownHosts += knownhosts.Line([]string{knownhosts.Normalize(server.Address)}, server.HostKey) + "\n"
+	}
+	assert.NoError(t, ioutil.WriteFile(knownHostsFile, []byte(knownHosts), 0600))
+	_, err = sshsync.DialSsh(hops[2], hops[:2])
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), servers[2].Address)
+	}
+	// the jump hosts it got through are logged out of again
+	assertNoConnections(t, servers)
+
+	knownHosts += knownhosts.Line([]string{knownhosts.Normalize(servers[2].Address)}, servers[2].HostKey) + "\n"
+	assert.NoError(t, ioutil.WriteFile(knownHostsFile, []byte(knownHosts), 0600))
+	client, err := sshsync.DialSsh(hops[2], hops[:2])
+	if assert.NoError(t, err) {
+		for _, server := range servers {
+			assert.Equal(t, 1, server.Connections())
+		}
+		client.Close()
+	}
+	assertNoConnections(t, servers)
+	// each hop was reached through the one before it
+	assert.Equal(t, []string{servers[1].Address, servers[1].Address}, servers[0].Forwarded())
+	assert.Equal(t, []string{servers[2].Address, servers[2].Address}, servers[1].Forwarded())
+}
+
+func assertNoConnections(t *testing.T, servers []*testSshServer) {
+	deadline := time.Now().Add(2 * time.Second)
+	for _, server := range servers {
+		for server.Connections() > 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Equal(t, 0, server.Connections(), server.Address)
+	}
+}
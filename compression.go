@@ -0,0 +1,186 @@
+package sshsync
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	CompressionZstd = "zstd"
+	CompressionGzip = "gzip"
+	CompressionNone = "none"
+)
+
+// in order of preference
+var Compressions = []string{CompressionZstd, CompressionGzip, CompressionNone}
+
+// negotiation happens before rpc starts, one line each way
+const compressionLine = "compression"
+
+// how long to wait for the server to pick a compression,
+// servers from before compression never answer
+const compressionTimeout = 10 * time.Second
+
+// compressors that can push out what they have so far
+type flushWriteCloser interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// compresses every write on its own, so that each rpc message is sent right away
+// instead of waiting in the compressor for more data
+type compressedConn struct {
+	conn io.ReadWriteCloser
+	// the decompressor is only made on the first read, because gzip reads its
+	// header right away, which the other side only sends with its first message
+	newReader func() (io.Reader, error)
+	reader    io.Reader
+	writer    flushWriteCloser
+}
+
+func (c *compressedConn) Read(p []byte) (int, error) {
+	if c.reader == nil {
+		reader, err := c.newReader()
+		if err != nil {
+			return 0, err
+		}
+		c.reader = reader
+	}
+	return c.reader.Read(p)
+}
+
+func (c *compressedConn) Write(p []byte) (int, error) {
+	n, err := c.writer.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, c.writer.Flush()
+}
+
+// the decompressor is left alone, it may be in the middle of a read on
+// another goroutine, which fails once conn is closed
+func (c *compressedConn) Close() error {
+	c.writer.Close()
+	return c.conn.Close()
+}
+
+// reads come from r, which may have buffered part of conn already
+func wrapCompression(compression string, r io.Reader, conn io.ReadWriteCloser) (io.ReadWriteCloser, error) {
+	switch compression {
+	case CompressionNone:
+		return &ReadWriteCloseAdapter{r, conn}, nil
+	case CompressionGzip:
+		return &compressedConn{
+			conn: conn,
+			newReader: func() (io.Reader, error) {
+				return gzip.NewReader(r)
+			},
+			writer: gzip.NewWriter(conn),
+		}, nil
+	case CompressionZstd:
+		writer, err := zstd.NewWriter(conn, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return &compressedConn{
+			conn: conn,
+			newReader: func() (io.Reader, error) {
+				// synchronous, so nothing waits for more input than there is
+				return zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+			},
+			writer: writer,
+		}, nil
+	}
+	return nil, errors.New("unknown compression: " + compression)
+}
+
+// reads a line without reading past it, since everything after it is compressed
+func readLineUnbuffered(r io.Reader) (string, error) {
+	line := []byte{}
+	b := make([]byte, 1)
+	for {
+		_, err := io.ReadFull(r, b)
+		if err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			return string(line), nil
+		}
+		line = append(line, b[0])
+	}
+}
+
+// the client offers compressions in order of preference, and the server picks one
+func OfferCompression(conn io.ReadWriteCloser, offers []string) (io.ReadWriteCloser, string, error) {
+	_, err := fmt.Fprintln(conn, compressionLine, strings.Join(offers, " "))
+	if err != nil {
+		return nil, "", err
+	}
+
+	type answer struct {
+		line string
+		err  error
+	}
+	answers := make(chan answer, 1)
+	go func() {
+		line, err := readLineUnbuffered(conn)
+		answers <- answer{line, err}
+	}()
+	var line string
+	select {
+	case a := <-answers:
+		if a.err != nil {
+			return nil, "", errors.Wrap(a.err, "negotiate compression")
+		}
+		line = a.line
+	case <-time.After(compressionTimeout):
+		conn.Close()
+		return nil, "", errors.New("server did not answer the compression negotiation, " +
+			"it may run an older sshsync than " + Version)
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) != 2 || fields[0] != compressionLine {
+		return nil, "", errors.Errorf("unexpected compression answer from server: %q", line)
+	}
+	compression := fields[1]
+	if !hasFeature(offers, compression) {
+		return nil, "", errors.New("server picked compression that was not offered: " + compression)
+	}
+	wrapped, err := wrapCompression(compression, conn, conn)
+	return wrapped, compression, err
+}
+
+// picks the first compression the client offers that this side supports
+func AcceptCompression(r *bufio.Reader, conn io.ReadWriteCloser) (io.ReadWriteCloser, string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, "", errors.Wrap(err, "negotiate compression")
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 || fields[0] != compressionLine {
+		return nil, "", errors.Errorf("expected compression offer from client, got %q", line)
+	}
+	compression := ""
+	for _, offer := range fields[1:] {
+		if hasFeature(Compressions, offer) {
+			compression = offer
+			break
+		}
+	}
+	if compression == "" {
+		return nil, "", errors.New("no common compression in " + line)
+	}
+	_, err = fmt.Fprintln(conn, compressionLine, compression)
+	if err != nil {
+		return nil, "", err
+	}
+	wrapped, err := wrapCompression(compression, r, conn)
+	return wrapped, compression, err
+}
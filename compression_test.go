@@ -0,0 +1,81 @@
+package sshsync_test
+
+import (
+	"bufio"
+	"github.com/Joshua-Wright/sshsync"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/rpc"
+	"strings"
+	"testing"
+)
+
+// counts what the client sends over the wire
+type countingConn struct {
+	io.ReadWriteCloser
+	written int
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	c.written += len(p)
+	return c.ReadWriteCloser.Write(p)
+}
+
+func TestCompression(t *testing.T) {
+	content := strings.Repeat("a line of source code that repeats a lot\n", 10000)
+	sent := map[string]int{}
+
+	for _, compression := range sshsync.Compressions {
+		serverFs := afero.NewMemMapFs()
+		server := sshsync.NewServerConfig(serverFs)
+		clientConn, serverConn := sshsync.TwoWayPipe()
+		accepted := make(chan string, 1)
+		go func() {
+			conn, compression, err := sshsync.AcceptCompression(bufio.NewReader(serverConn), serverConn)
+			assert.NoError(t, err)
+			accepted <- compression
+			if err == nil {
+				server.ReadCommands(conn)
+			}
+		}()
+
+		counted := &countingConn{ReadWriteCloser: clientConn}
+		conn, picked, err := sshsync.OfferCompression(counted, []string{compression, sshsync.CompressionNone})
+		if !assert.NoError(t, err) {
+			continue
+		}
+		assert.Equal(t, compression, picked)
+		assert.Equal(t, compression, <-accepted)
+
+		clientFs := afero.NewMemMapFs()
+		assert.NoError(t, afero.WriteFile(clientFs, "big.txt", []byte(content), 0644))
+		c := &sshsync.ClientFolder{
+			ClientFs:  clientFs,
+			FileCache: make(map[string]string),
+			Client:    rpc.NewClient(conn),
+		}
+		c.BuildCache()
+		assert.NoError(t, c.Hello())
+		assert.NoError(t, c.SendCompleteTextFiles([]string{"big.txt"}))
+		AssertFileContent(t, serverFs, "big.txt", content)
+		assert.NoError(t, c.AssertClientAndServerMatch())
+		sent[compression] = counted.written
+		c.Close()
+	}
+
+	assert.True(t, sent[sshsync.CompressionNone] > len(content))
+	assert.True(t, sent[sshsync.CompressionGzip] < len(content)/10, "gzip sent %d bytes", sent[sshsync.CompressionGzip])
+	assert.True(t, sent[sshsync.CompressionZstd] < len(content)/10, "zstd sent %d bytes", sent[sshsync.CompressionZstd])
+}
+
+func TestCompressionNoCommon(t *testing.T) {
+	clientConn, serverConn := sshsync.TwoWayPipe()
+	go func() {
+		_, _, err := sshsync.AcceptCompression(bufio.NewReader(serverConn), serverConn)
+		assert.Error(t, err)
+		serverConn.Close()
+	}()
+	_, _, err := sshsync.OfferCompression(clientConn, []string{"lz4"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,294 @@
+package sshsync
+
+import (
+	"github.com/BurntSushi/toml"
+	"github.com/fsnotify/fsnotify"
+	"github.com/gobwas/glob"
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+	"gopkg.in/yaml.v2"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// files in the synced root that change what is synced
+const (
+	SyncIgnoreFile = ".sshsyncignore"
+	ConfigFileToml = ".sshsync.toml"
+	ConfigFileYaml = ".sshsync.yaml"
+	ConfigFileYml  = ".sshsync.yml"
+)
+
+// tried in this order, only the first one found is used
+var configFiles = []string{ConfigFileToml, ConfigFileYaml, ConfigFileYml}
+
+// what .sshsync.toml or .sshsync.yaml can set, on top of DefaultIgnoreConfig
+type ProjectConfig struct {
+	// if not empty, only files with these extensions are synced
+	Extensions []string `toml:"extensions" yaml:"extensions"`
+	// globs of paths to skip, in addition to the default ones
+	Ignore []string `toml:"ignore" yaml:"ignore"`
+	// files bigger than this many bytes are skipped, 0 for no limit
+	MaxFileSize int64 `toml:"max_file_size" yaml:"max_file_size"`
+	// follow .gitignore files, defaults to true
+	GitIgnore *bool `toml:"gitignore" yaml:"gitignore"`
+	// sync files and folders starting with a dot, except .git
+	Hidden bool `toml:"hidden" yaml:"hidden"`
+}
+
+// whether path is one of the files that change what is ignored
+func IsIgnoreConfigFile(path string) bool {
+	path = filepath.Clean(path)
+	if path == SyncIgnoreFile || filepath.Base(path) == GitIgnoreFile {
+		return true
+	}
+	for _, file := range configFiles {
+		if path == file {
+			return true
+		}
+	}
+	return false
+}
+
+func readProjectConfig(fs afero.Fs) (ProjectConfig, string, error) {
+	project := ProjectConfig{}
+	for _, file := range configFiles {
+		buf, err := afero.ReadFile(fs, file)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return project, file, err
+		}
+		if file == ConfigFileToml {
+			err = toml.Unmarshal(buf, &project)
+		} else {
+			err = yaml.UnmarshalStrict(buf, &project)
+		}
+		return project, file, errors.Wrap(err, file)
+	}
+	return project, "", nil
+}
+
+// DefaultIgnoreConfig with the config file from the root of fs applied, if there is one
+// .sshsyncignore is read by ShouldIgnore itself, like a .gitignore that always applies
+func LoadIgnoreConfig(fs afero.Fs) (IgnoreConfig, error) {
+	cfg := DefaultIgnoreConfig
+	project, file, err := readProjectConfig(fs)
+	if err != nil {
+		return cfg, err
+	}
+	if file == "" {
+		return cfg, nil
+	}
+
+	globs := []string{}
+	for _, globIgnore := range DefaultIgnoreConfig.GlobIgnore {
+		if project.Hidden && globIgnore == ".*" {
+			globs = append(globs, ".git", ".git/*")
+			continue
+		}
+		globs = append(globs, globIgnore)
+	}
+	for _, globIgnore := range project.Ignore {
+		if _, err := glob.Compile(globIgnore); err != nil {
+			return cfg, errors.Wrapf(err, "%s: bad glob pattern %s", file, globIgnore)
+		}
+		globs = append(globs, globIgnore)
+	}
+	cfg.GlobIgnore = globs
+	cfg.Extensions = project.Extensions
+	cfg.MaxFileSize = project.MaxFileSize
+	cfg.NoGitIgnore = project.GitIgnore != nil && !*project.GitIgnore
+	return cfg, nil
+}
+
+// picks up an edited config file
+// files that are not ignored anymore are sent, files that are ignored now are left
+// alone on the server
+func (c *ClientFolder) reloadIgnoreConfig(watcher *fsnotify.Watcher, changes *pendingChanges) bool {
+	cfg, err := LoadIgnoreConfig(c.ClientFs)
+	if err != nil {
+		log.Println("keeping the old ignore config", err)
+		return false
+	}
+	log.Println("reloaded ignore config")
+	c.IgnoreCfg = cfg
+	if c.Client != nil {
+		// otherwise it is sent when reconnecting
+		err = c.SendIgnoreConfig()
+		if err != nil {
+			log.Println("failed to send ignore config", err)
+		}
+	}
+	for path := range c.FileCache {
+		// deleted files are still sent as deletes
+		if _, err := c.ClientFs.Stat(path); err == nil && c.IgnoreCfg.ShouldIgnore(c.ClientFs, path) {
+			delete(c.FileCache, path)
+		}
+	}
+
+	found := false
+	err = c.addWatchTree(watcher, ".", func(path string) {
+		if _, ok := c.FileCache[path]; !ok {
+			changes.modified[path] = true
+			delete(changes.deleted, path)
+			found = true
+		}
+	})
+	if err != nil {
+		log.Println("failed to watch after reloading ignore config", err)
+	}
+	return found
+}
+
+// same as the client, returns the files that are not ignored anymore
+// does nothing once the client sent its own config
+func (c *ServerConfig) reloadIgnoreConfig(watcher *fsnotify.Watcher) []string {
+	cfg, err := LoadIgnoreConfig(c.ServerFs)
+	if err != nil {
+		log.Println("keeping the old ignore config", err)
+		return nil
+	}
+	c.mu.Lock()
+	if c.ignoreCfgFromClient {
+		c.mu.Unlock()
+		return nil
+	}
+	log.Println("reloaded ignore config")
+	c.IgnoreCfg = cfg
+	c.mu.Unlock()
+
+	err = c.addWatchTree(watcher, ".")
+	if err != nil {
+		log.Println("failed to watch after reloading ignore config", err)
+	}
+	found := []string{}
+	afero.Walk(c.ServerFs, ".", func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() && cfg.IgnoresDir(c.ServerFs, path) {
+			return filepath.SkipDir
+		}
+		if !info.IsDir() && !cfg.ShouldIgnore(c.ServerFs, path) {
+			found = append(found, path)
+		}
+		return nil
+	})
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	newPaths := []string{}
+	for _, path := range found {
+		if _, ok := c.fileCache[path]; !ok {
+			newPaths = append(newPaths, path)
+		}
+	}
+	return newPaths
+}
+
+const Server_SetIgnoreConfig = "Server.SetIgnoreConfig"
+
+// cfg with the contents of the ignore files in fs, so that the server follows
+// exactly the same rules as the client instead of its own files
+func (cfg IgnoreConfig) Snapshot(fs afero.Fs) IgnoreConfig {
+	files := make(map[string]string)
+	read := func(path string) {
+		buf, err := afero.ReadFile(fs, path)
+		if err == nil {
+			files[filepath.ToSlash(path)] = string(buf)
+		}
+	}
+	read(SyncIgnoreFile)
+	if !cfg.NoGitIgnore {
+		read(filepath.FromSlash(GitExcludeFile))
+		afero.Walk(fs, ".", func(path string, info os.FileInfo, err error) error {
+			if err != nil || !info.IsDir() {
+				return nil
+			}
+			if cfg.IgnoresDir(fs, path) {
+				return filepath.SkipDir
+			}
+			read(filepath.Join(path, GitIgnoreFile))
+			return nil
+		})
+	}
+
+	snapshot := cfg
+	snapshot.IgnoreFiles = files
+	snapshot.gitIgnoreCache = nil
+	return snapshot
+}
+
+// tells the server which files to sync, it rebuilds its cache with these rules
+func (c *ClientFolder) SendIgnoreConfig() error {
+	return c.Client.Call(Server_SetIgnoreConfig, c.IgnoreCfg.Snapshot(c.ClientFs), nil)
+}
+
+// from now on only the client's rules are used, the ignore files on the server don't count
+func (c *ServerConfig) SetIgnoreConfig(cfg IgnoreConfig, _ *int) error {
+	for _, globIgnore := range cfg.GlobIgnore {
+		if _, err := glob.Compile(globIgnore); err != nil {
+			return errors.Wrap(err, "bad glob pattern "+globIgnore)
+		}
+	}
+	if cfg.IgnoreFiles == nil {
+		cfg.IgnoreFiles = make(map[string]string)
+	}
+
+	// no file is written while the cache is rebuilt
+	c.treeMu.Lock()
+	fileCache := make(map[string]string)
+	err := afero.Walk(c.ServerFs, ".", func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if cfg.IgnoresDir(c.ServerFs, path) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !cfg.ShouldIgnore(c.ServerFs, path) {
+			buf, err := afero.ReadFile(c.ServerFs, path)
+			if err != nil {
+				return err
+			}
+			fileCache[path] = string(buf)
+		}
+		return nil
+	})
+	if err != nil {
+		c.treeMu.Unlock()
+		return err
+	}
+	c.mu.Lock()
+	c.IgnoreCfg = cfg
+	c.ignoreCfgFromClient = true
+	c.fileCache = fileCache
+	watcher := c.watcher
+	c.mu.Unlock()
+	c.treeMu.Unlock()
+	log.Println("using the client's ignore config,", len(fileCache), "files")
+
+	// folders that were ignored before may have to be watched now
+	if watcher != nil {
+		err = c.addWatchTree(watcher, ".")
+		if err != nil {
+			log.Println("failed to watch after setting ignore config", err)
+		}
+	}
+	return nil
+}
+
+// the ignore config can be replaced by the client at any time,
+// so the watcher works on a copy
+func (c *ServerConfig) ignoreConfig() IgnoreConfig {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// made once here, instead of again in every copy
+	c.IgnoreCfg.compileGlobs()
+	c.IgnoreCfg.gitIgnores()
+	return c.IgnoreCfg
+}
@@ -0,0 +1,117 @@
+package sshsync_test
+
+import (
+	"github.com/Joshua-Wright/sshsync"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadIgnoreConfig(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	cfg, err := sshsync.LoadIgnoreConfig(fs)
+	assert.NoError(t, err)
+	assert.Equal(t, sshsync.DefaultIgnoreConfig.GlobIgnore, cfg.GlobIgnore)
+
+	assert.NoError(t, afero.WriteFile(fs, sshsync.ConfigFileToml, []byte(
+		"extensions = [\".go\", \".md\"]\n"+
+			"ignore = [\"vendor/*\"]\n"+
+			"max_file_size = 10\n"+
+			"gitignore = false\n"+
+			"hidden = true\n"), 0644))
+	assert.NoError(t, afero.WriteFile(fs, ".gitignore", []byte("*.md\n"), 0644))
+	assert.NoError(t, afero.WriteFile(fs, "main.go", []byte("package a"), 0644))
+	assert.NoError(t, afero.WriteFile(fs, "big.go", []byte("package big"), 0644))
+	assert.NoError(t, afero.WriteFile(fs, "README.md", []byte{}, 0644))
+	assert.NoError(t, afero.WriteFile(fs, "notes.txt", []byte{}, 0644))
+	assert.NoError(t, afero.WriteFile(fs, ".editorconfig.md", []byte{}, 0644))
+	assert.NoError(t, afero.WriteFile(fs, ".git/HEAD.md", []byte{}, 0644))
+	assert.NoError(t, afero.WriteFile(fs, "vendor/lib.go", []byte{}, 0644))
+
+	cfg, err = sshsync.LoadIgnoreConfig(fs)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), cfg.MaxFileSize)
+	assert.False(t, cfg.ShouldIgnore(fs, "main.go"))
+	assert.True(t, cfg.ShouldIgnore(fs, "big.go"))
+	assert.False(t, cfg.ShouldIgnore(fs, "README.md"))
+	assert.True(t, cfg.ShouldIgnore(fs, "notes.txt"))
+	assert.False(t, cfg.ShouldIgnore(fs, ".editorconfig.md"))
+	assert.True(t, cfg.ShouldIgnore(fs, ".git/HEAD.md"))
+	assert.True(t, cfg.ShouldIgnore(fs, "vendor/lib.go"))
+}
+
+func TestLoadIgnoreConfigYaml(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(fs, sshsync.ConfigFileYaml, []byte(
+		"ignore:\n  - \"*.tmp\"\nmax_file_size: 100\n"), 0644))
+	cfg, err := sshsync.LoadIgnoreConfig(fs)
+	assert.NoError(t, err)
+	assert.Contains(t, cfg.GlobIgnore, "*.tmp")
+	assert.Equal(t, int64(100), cfg.MaxFileSize)
+
+	assert.NoError(t, afero.WriteFile(fs, sshsync.ConfigFileYaml, []byte("max_size: 100\n"), 0644))
+	_, err = sshsync.LoadIgnoreConfig(fs)
+	assert.Error(t, err)
+
+	assert.NoError(t, afero.WriteFile(fs, sshsync.ConfigFileYaml, []byte("ignore: [\"[\"]\n"), 0644))
+	_, err = sshsync.LoadIgnoreConfig(fs)
+	assert.Error(t, err)
+}
+
+func TestSyncIgnoreFile(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	assert.NoError(t, afero.WriteFile(fs, ".gitignore", []byte("*.log\n"), 0644))
+	assert.NoError(t, afero.WriteFile(fs, sshsync.SyncIgnoreFile, []byte("!wanted.log\ndata/\n"), 0644))
+	assert.NoError(t, afero.WriteFile(fs, "wanted.log", []byte{}, 0644))
+	assert.NoError(t, afero.WriteFile(fs, "other.log", []byte{}, 0644))
+	assert.NoError(t, afero.WriteFile(fs, "data/big.csv", []byte{}, 0644))
+
+	cfg, err := sshsync.LoadIgnoreConfig(fs)
+	assert.NoError(t, err)
+	assert.False(t, cfg.ShouldIgnore(fs, "wanted.log"))
+	assert.True(t, cfg.ShouldIgnore(fs, "other.log"))
+	assert.True(t, cfg.ShouldIgnore(fs, "data/big.csv"))
+	assert.True(t, sshsync.IsIgnoreConfigFile(sshsync.SyncIgnoreFile))
+	assert.True(t, sshsync.IsIgnoreConfigFile(sshsync.ConfigFileToml))
+	assert.False(t, sshsync.IsIgnoreConfigFile("sub/"+sshsync.ConfigFileToml))
+}
+
+func TestServerReloadIgnoreConfig(t *testing.T) {
+	WithFolder(t, "TestServerReloadIgnoreConfig", func(serverPath string, serverFs afero.Fs) {
+		assert.NoError(t, afero.WriteFile(serverFs, sshsync.SyncIgnoreFile, []byte("*.gen\n"), 0644))
+		assert.NoError(t, afero.WriteFile(serverFs, "code.gen", []byte("generated"), 0644))
+
+		server := sshsync.NewServerConfig(serverFs)
+		server.BuildCache()
+		assert.NoError(t, server.StartWatchFiles(serverPath))
+		defer server.Close()
+		clientConn, serverConn := sshsync.TwoWayPipe()
+		go server.ReadCommands(serverConn)
+		client := rpc.NewClient(clientConn)
+
+		// no longer ignored, so it is sent like a new file
+		assert.NoError(t, os.WriteFile(filepath.Join(serverPath, sshsync.SyncIgnoreFile), []byte{}, 0644))
+
+		changes := []sshsync.FileChange{}
+		deadline := time.Now().Add(5 * time.Second)
+		for len(changes) < 1 && time.Now().Before(deadline) {
+			var polled []sshsync.FileChange
+			err := client.Call(sshsync.Server_PollChanges, 0, &polled)
+			assert.NoError(t, err)
+			changes = append(changes, polled...)
+		}
+		assert.Len(t, changes, 1)
+		if len(changes) == 1 {
+			assert.Equal(t, "code.gen", changes[0].Path)
+			assert.Equal(t, "generated", changes[0].Content)
+		}
+
+		client.Close()
+		clientConn.Close()
+		serverConn.Close()
+	})
+}
@@ -0,0 +1,132 @@
+package sshsync
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// runs a shell command on the server, and returns what it printed
+type RemoteRunner func(command string, stdin io.Reader) (string, error)
+
+func SshRunner(client *ssh.Client) RemoteRunner {
+	return func(command string, stdin io.Reader) (string, error) {
+		session, err := client.NewSession()
+		if err != nil {
+			return "", err
+		}
+		defer session.Close()
+		session.Stdin = stdin
+		out, err := session.Output(command)
+		return string(out), err
+	}
+}
+
+// makes sure the server has this version of sshsync, uploading it to
+// ~/.cache/sshsync/<version> if it hasn't
+type Deployer struct {
+	Run RemoteRunner
+	// finds a local sshsync binary for the server, nil uses LocalServerBinary
+	Binary func(goos, goarch string) (string, error)
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// GOOS and GOARCH for what uname prints
+func goPlatform(kernel, machine string) (goos, goarch string) {
+	goos = strings.ToLower(kernel)
+	switch machine {
+	case "x86_64", "amd64":
+		goarch = "amd64"
+	case "aarch64", "arm64":
+		goarch = "arm64"
+	case "i386", "i686":
+		goarch = "386"
+	default:
+		if strings.HasPrefix(machine, "arm") {
+			goarch = "arm"
+		} else {
+			goarch = machine
+		}
+	}
+	return
+}
+
+// this binary if it runs on goos/goarch, otherwise sshsync-<goos>-<goarch> next to it
+func LocalServerBinary(goos, goarch string) (string, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	if goos == runtime.GOOS && goarch == runtime.GOARCH {
+		return self, nil
+	}
+	binary := filepath.Join(filepath.Dir(self), BinName+"-"+goos+"-"+goarch)
+	if _, err := os.Stat(binary); err != nil {
+		return "", errors.Errorf("no sshsync for %s/%s, build one with: GOOS=%s GOARCH=%s go build -o %s",
+			goos, goarch, goos, goarch, binary)
+	}
+	return binary, nil
+}
+
+func (d *Deployer) hasVersion(command string) bool {
+	out, err := d.Run(command+" -version", nil)
+	return err == nil && strings.TrimSpace(out) == FullVersion
+}
+
+// returns the command that starts the right sshsync on the server
+func (d *Deployer) Deploy() (string, error) {
+	out, err := d.Run("uname -s; uname -m; echo $HOME", nil)
+	if err != nil {
+		return "", errors.Wrap(err, "probe server")
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 3 {
+		return "", errors.Errorf("unexpected answer to probing the server: %q", out)
+	}
+	goos, goarch := goPlatform(strings.TrimSpace(lines[0]), strings.TrimSpace(lines[1]))
+	dir := path.Join(strings.TrimSpace(lines[2]), ".cache", BinName, FullVersion)
+	cached := shellQuote(path.Join(dir, BinName))
+
+	if d.hasVersion(cached) {
+		return cached, nil
+	}
+	if d.hasVersion(BinName) {
+		return BinName, nil
+	}
+
+	findBinary := d.Binary
+	if findBinary == nil {
+		findBinary = LocalServerBinary
+	}
+	binary, err := findBinary(goos, goarch)
+	if err != nil {
+		return "", err
+	}
+	fp, err := os.Open(binary)
+	if err != nil {
+		return "", err
+	}
+	defer fp.Close()
+
+	log.Println("uploading", binary, "to", dir)
+	tmp := shellQuote(path.Join(dir, BinName+".tmp"))
+	_, err = d.Run(fmt.Sprintf("mkdir -p %s && cat > %s && chmod 755 %s && mv %s %s",
+		shellQuote(dir), tmp, tmp, tmp, cached), fp)
+	if err != nil {
+		return "", errors.Wrap(err, "upload sshsync")
+	}
+	if !d.hasVersion(cached) {
+		return "", errors.Errorf("uploaded %s does not run on the server (%s/%s)", binary, goos, goarch)
+	}
+	return cached, nil
+}
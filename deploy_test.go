@@ -0,0 +1,82 @@
+package sshsync_test
+
+import (
+	"bytes"
+	"github.com/Joshua-Wright/sshsync"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDeployer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestDeployer")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	home := filepath.Join(dir, "home")
+	assert.NoError(t, os.Mkdir(home, 0755))
+
+	// stands in for the real binary
+	binary := filepath.Join(dir, "sshsync-test")
+	assert.NoError(t, ioutil.WriteFile(binary, []byte("#!/bin/sh\necho "+sshsync.FullVersion+"\n"), 0755))
+
+	// runs commands here instead of on a server, with an empty PATH so that
+	// sshsync is never installed already
+	commands := []string{}
+	run := func(command string, stdin io.Reader) (string, error) {
+		commands = append(commands, command)
+		cmd := exec.Command("/bin/sh", "-c", command)
+		cmd.Env = []string{"HOME=" + home, "PATH=/bin:/usr/bin"}
+		cmd.Stdin = stdin
+		out := &bytes.Buffer{}
+		cmd.Stdout = out
+		err := cmd.Run()
+		return out.String(), err
+	}
+	platforms := []string{}
+	d := &sshsync.Deployer{
+		Run: run,
+		Binary: func(goos, goarch string) (string, error) {
+			platforms = append(platforms, goos+"/"+goarch)
+			return binary, nil
+		},
+	}
+
+	command, err := d.Deploy()
+	assert.NoError(t, err)
+	installed := filepath.Join(home, ".cache", "sshsync", sshsync.FullVersion, "sshsync")
+	assert.Equal(t, "'"+installed+"'", command)
+	info, err := os.Stat(installed)
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+	}
+	assert.Len(t, platforms, 1)
+
+	// the second time it is already there
+	commands = nil
+	command, err = d.Deploy()
+	assert.NoError(t, err)
+	assert.Equal(t, "'"+installed+"'", command)
+	assert.Len(t, platforms, 1)
+	for _, command := range commands {
+		assert.False(t, strings.Contains(command, "cat >"), command)
+	}
+
+	// the same version with another protocol is replaced
+	assert.NoError(t, ioutil.WriteFile(installed, []byte("#!/bin/sh\necho "+sshsync.Version+"\n"), 0755))
+	commands = nil
+	command, err = d.Deploy()
+	assert.NoError(t, err)
+	assert.Equal(t, "'"+installed+"'", command)
+	assert.Len(t, platforms, 2)
+
+	// a binary that doesn't run on the server is an error
+	assert.NoError(t, ioutil.WriteFile(installed, []byte("#!/bin/sh\necho 0.0.1\n"), 0755))
+	assert.NoError(t, ioutil.WriteFile(binary, []byte("#!/bin/sh\nexit 1\n"), 0755))
+	_, err = d.Deploy()
+	assert.Error(t, err)
+}
@@ -0,0 +1,254 @@
+package sshsync
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/spf13/afero"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	GitIgnoreFile  = ".gitignore"
+	GitExcludeFile = ".git/info/exclude"
+)
+
+// one line of a .gitignore file
+type gitIgnorePattern struct {
+	regexp *regexp.Regexp
+	// starts with !, re-includes what an earlier pattern excluded
+	negate bool
+	// ends with /, only matches folders
+	dirOnly bool
+}
+
+// the patterns of one .gitignore file, kept until the file changes
+type gitIgnoreFile struct {
+	modTime  time.Time
+	size     int64
+	patterns []gitIgnorePattern
+}
+
+// parsed .gitignore files by path, so that they are not read again for every file
+type gitIgnoreCache struct {
+	mu    sync.Mutex
+	files map[string]*gitIgnoreFile
+	// contents sent by the client, used instead of the files on disk, see Snapshot
+	sent map[string]string
+}
+
+// guards creating the cache, since IgnoreConfig is copied around by value
+var gitIgnoreCacheMu sync.Mutex
+
+func (cfg *IgnoreConfig) gitIgnores() *gitIgnoreCache {
+	gitIgnoreCacheMu.Lock()
+	defer gitIgnoreCacheMu.Unlock()
+	if cfg.gitIgnoreCache == nil {
+		cfg.gitIgnoreCache = &gitIgnoreCache{
+			files: make(map[string]*gitIgnoreFile),
+			sent:  cfg.IgnoreFiles,
+		}
+	}
+	return cfg.gitIgnoreCache
+}
+
+// turns a pattern into a regexp on slash separated paths relative to the folder
+// of the .gitignore file
+// returns nil for lines that are blank or comments
+func compileGitIgnoreLine(line string) *gitIgnorePattern {
+	// trailing spaces don't count, unless they are escaped
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil
+	}
+
+	pattern := &gitIgnorePattern{}
+	if strings.HasPrefix(line, "!") {
+		pattern.negate = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		pattern.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return nil
+	}
+	// a slash anywhere but at the end anchors the pattern to the folder of the .gitignore,
+	// otherwise it matches at any depth
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+
+	expr := &bytes.Buffer{}
+	expr.WriteString("^")
+	if !anchored {
+		expr.WriteString("(?:.*/)?")
+	}
+	for i := 0; i < len(line); i++ {
+		atSegmentStart := i == 0 || line[i-1] == '/'
+		rest := line[i:]
+		switch {
+		case atSegmentStart && rest == "**":
+			expr.WriteString(".*")
+			i++
+		case atSegmentStart && strings.HasPrefix(rest, "**/"):
+			// any number of folders, including none
+			expr.WriteString("(?:.*/)?")
+			i += 2
+		case rest == "/**":
+			// everything inside, but not the folder itself
+			expr.WriteString("/.+")
+			i += 2
+		case line[i] == '*':
+			expr.WriteString("[^/]*")
+		case line[i] == '?':
+			expr.WriteString("[^/]")
+		case line[i] == '[':
+			end := strings.Index(line[i+1:], "]")
+			if end == -1 {
+				expr.WriteString(regexp.QuoteMeta("["))
+				continue
+			}
+			class := line[i+1 : i+1+end]
+			expr.WriteString("[")
+			if strings.HasPrefix(class, "!") || strings.HasPrefix(class, "^") {
+				expr.WriteString("^/")
+				class = class[1:]
+			}
+			expr.WriteString(strings.Replace(class, "\\", "\\\\", -1))
+			expr.WriteString("]")
+			i += end + 1
+		case line[i] == '\\' && i+1 < len(line):
+			i++
+			expr.WriteString(regexp.QuoteMeta(line[i : i+1]))
+		default:
+			expr.WriteString(regexp.QuoteMeta(line[i : i+1]))
+		}
+	}
+	expr.WriteString("$")
+
+	compiled, err := regexp.Compile(expr.String())
+	if err != nil {
+		// git skips patterns it can't make sense of too
+		return nil
+	}
+	pattern.regexp = compiled
+	return pattern
+}
+
+func parseGitIgnore(buf []byte) []gitIgnorePattern {
+	patterns := []gitIgnorePattern{}
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	for scanner.Scan() {
+		pattern := compileGitIgnoreLine(strings.TrimSuffix(scanner.Text(), "\r"))
+		if pattern != nil {
+			patterns = append(patterns, *pattern)
+		}
+	}
+	return patterns
+}
+
+// patterns of the file at ignorePath, read again only when it changed
+func (g *gitIgnoreCache) patterns(fs afero.Fs, ignorePath string) []gitIgnorePattern {
+	if g.sent != nil {
+		return g.sentPatterns(filepath.ToSlash(ignorePath))
+	}
+	info, err := fs.Stat(ignorePath)
+	if err != nil || info.IsDir() {
+		return nil
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	file, ok := g.files[ignorePath]
+	if ok && file.modTime.Equal(info.ModTime()) && file.size == info.Size() {
+		return file.patterns
+	}
+	buf, err := afero.ReadFile(fs, ignorePath)
+	if err != nil {
+		return nil
+	}
+	file = &gitIgnoreFile{
+		modTime:  info.ModTime(),
+		size:     info.Size(),
+		patterns: parseGitIgnore(buf),
+	}
+	g.files[ignorePath] = file
+	return file.patterns
+}
+
+func (g *gitIgnoreCache) sentPatterns(ignorePath string) []gitIgnorePattern {
+	content, ok := g.sent[ignorePath]
+	if !ok {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	file, ok := g.files[ignorePath]
+	if !ok {
+		file = &gitIgnoreFile{patterns: parseGitIgnore([]byte(content))}
+		g.files[ignorePath] = file
+	}
+	return file.patterns
+}
+
+// whether the gitignore files exclude this exact path, not looking at its parents
+// later patterns override earlier ones, and deeper .gitignore files override
+// the ones above them and .git/info/exclude, and .sshsyncignore overrides them all
+func (g *gitIgnoreCache) excludes(fs afero.Fs, relPath string, isDir, followGitIgnore bool) bool {
+	excluded := false
+	match := func(patterns []gitIgnorePattern, rel string) {
+		for _, pattern := range patterns {
+			if pattern.dirOnly && !isDir {
+				continue
+			}
+			if pattern.regexp.MatchString(rel) {
+				excluded = !pattern.negate
+			}
+		}
+	}
+
+	if followGitIgnore {
+		match(g.patterns(fs, filepath.FromSlash(GitExcludeFile)), relPath)
+		segments := strings.Split(relPath, "/")
+		for i := range segments {
+			dir := strings.Join(segments[:i], "/")
+			match(g.patterns(fs, filepath.FromSlash(path.Join(dir, GitIgnoreFile))), strings.Join(segments[i:], "/"))
+		}
+	}
+	// same syntax, but only in the root and over anything git says
+	match(g.patterns(fs, SyncIgnoreFile), relPath)
+	return excluded
+}
+
+// whether git would ignore path, which it does when any folder above it is ignored,
+// even if a later pattern re-includes the path itself
+func (cfg *IgnoreConfig) gitIgnored(fs afero.Fs, relPath string, isDir bool) bool {
+	relPath = path.Clean(filepath.ToSlash(relPath))
+	if relPath == "." || relPath == "" {
+		return false
+	}
+	g := cfg.gitIgnores()
+	segments := strings.Split(relPath, "/")
+	for i := 1; i <= len(segments); i++ {
+		last := i == len(segments)
+		if g.excludes(fs, strings.Join(segments[:i], "/"), !last || isDir, !cfg.NoGitIgnore) {
+			return true
+		}
+	}
+	return false
+}
+
+// whether a walk should skip the folder at path and everything in it
+func (cfg *IgnoreConfig) IgnoresDir(fs afero.Fs, path string) bool {
+	if path == "." {
+		return false
+	}
+	return cfg.matchesGlob(path) || cfg.gitIgnored(fs, path, true)
+}
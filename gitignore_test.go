@@ -0,0 +1,103 @@
+package sshsync_test
+
+import (
+	"github.com/Joshua-Wright/sshsync"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestIgnoreConfig_GitIgnore(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	cfg := &sshsync.IgnoreConfig{}
+	files := map[string]string{
+		".gitignore": "# comment\n" +
+			"node_modules/\n" +
+			"*.log\n" +
+			"!keep.log\n" +
+			"/root-only.txt\n" +
+			"docs/**/*.pdf\n" +
+			"generated/\n" +
+			"!generated/wanted.txt\n" +
+			"cache/**\n" +
+			"tmp?.txt\n" +
+			"\\#hash.txt\n" +
+			"trailing.txt   \n",
+		".git/info/exclude":         "local.txt\n",
+		"sub/.gitignore":            "!important.log\n/anchored.txt\nbuild\n",
+		"sub/deeper/.gitignore":     "*.txt\n",
+		"node_modules/pkg/index.js": "",
+		"a/node_modules/x.js":       "",
+		"app.log":                   "",
+		"keep.log":                  "",
+		"sub/important.log":         "",
+		"sub/other.log":             "",
+		"root-only.txt":             "",
+		"sub/root-only.txt":         "",
+		"sub/anchored.txt":          "",
+		"sub/x/anchored.txt":        "",
+		"sub/build/out.bin":         "",
+		"sub/deeper/notes.txt":      "",
+		"sub/deeper/main.go":        "",
+		"docs/a.pdf":                "",
+		"docs/x/y/b.pdf":            "",
+		"docs/a.md":                 "",
+		"generated/wanted.txt":      "",
+		"cache/data":                "",
+		"tmp1.txt":                  "",
+		"tmp12.txt":                 "",
+		"#hash.txt":                 "",
+		"trailing.txt":              "",
+		"local.txt":                 "",
+		"main.go":                   "",
+	}
+	for path, content := range files {
+		assert.NoError(t, afero.WriteFile(fs, path, []byte(content), 0644))
+	}
+
+	ignored := []string{
+		"node_modules/pkg/index.js",
+		"a/node_modules/x.js",
+		"app.log",
+		"sub/other.log",
+		"root-only.txt",
+		"sub/anchored.txt",
+		"sub/build/out.bin",
+		"sub/deeper/notes.txt",
+		"docs/a.pdf",
+		"docs/x/y/b.pdf",
+		// can't re-include a file when its folder is excluded
+		"generated/wanted.txt",
+		"cache/data",
+		"tmp1.txt",
+		"#hash.txt",
+		"trailing.txt",
+		"local.txt",
+	}
+	synced := []string{
+		"keep.log",
+		"sub/important.log",
+		"sub/root-only.txt",
+		"sub/x/anchored.txt",
+		"sub/deeper/main.go",
+		"docs/a.md",
+		"tmp12.txt",
+		"main.go",
+	}
+	for _, path := range ignored {
+		assert.True(t, cfg.ShouldIgnore(fs, path), path)
+	}
+	for _, path := range synced {
+		assert.False(t, cfg.ShouldIgnore(fs, path), path)
+	}
+
+	assert.True(t, cfg.IgnoresDir(fs, "node_modules"))
+	assert.True(t, cfg.IgnoresDir(fs, "a/node_modules"))
+	assert.False(t, cfg.IgnoresDir(fs, "sub"))
+	assert.False(t, cfg.IgnoresDir(fs, "."))
+
+	// picked up again once the .gitignore changes
+	assert.NoError(t, afero.WriteFile(fs, ".gitignore", []byte("main.go\n"), 0644))
+	assert.True(t, cfg.ShouldIgnore(fs, "main.go"))
+	assert.False(t, cfg.ShouldIgnore(fs, "app.log"))
+}
@@ -0,0 +1,84 @@
+package sshsync
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/pkg/errors"
+	"github.com/zeebo/blake3"
+	"github.com/zeebo/xxh3"
+	"hash"
+	"time"
+)
+
+// hashes for telling whether the client and the server have the same file
+const (
+	HashXxh3   = "xxh3"
+	HashBlake3 = "blake3"
+	HashSha256 = "sha256"
+)
+
+// in order of preference
+var Hashes = []string{HashXxh3, HashBlake3, HashSha256}
+
+var newHashes = map[string]func() hash.Hash{
+	// the 128 bit one, 64 bits are too few to trust across thousands of files
+	HashXxh3:   func() hash.Hash { return xxh3.New128() },
+	HashBlake3: func() hash.Hash { return blake3.New() },
+	HashSha256: sha256.New,
+}
+
+// the first hash in offered that this side has, "" if there is none
+func pickHash(offered []string) string {
+	for _, name := range offered {
+		if _, ok := newHashes[name]; ok {
+			return name
+		}
+	}
+	return ""
+}
+
+// hex encoded, so that it can be compared and logged as it is
+func hashContent(name string, content string) (string, error) {
+	newHash, ok := newHashes[name]
+	if !ok {
+		return "", errors.New("unknown hash: " + name)
+	}
+	h := newHash()
+	h.Write([]byte(content))
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// what the server knows about a file without sending it
+type FileIndexEntry struct {
+	Size    int64
+	ModTime time.Time
+	// empty unless asked for
+	Hash string
+}
+
+// map of Path to FileIndexEntry
+type FileIndex map[string]FileIndexEntry
+
+type FileIndexRequest struct {
+	// one of Hashes, or empty for only size and modification time,
+	// which is enough to tell most files apart without reading them
+	Hash string
+	// all files if nil
+	Paths []string
+}
+
+func (c *ClientFolder) hashes() []string {
+	if c.Hashes == nil {
+		return Hashes
+	}
+	return c.Hashes
+}
+
+// the hash agreed on in Hello
+func (c *ClientFolder) indexHash() string {
+	if c.ServerInfo.Hash == "" {
+		// no Hello yet, the server has all hashes this version has
+		return c.hashes()[0]
+	}
+	return c.ServerInfo.Hash
+}
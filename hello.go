@@ -0,0 +1,135 @@
+package sshsync
+
+import (
+	"github.com/pkg/errors"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// bumped whenever the rpc types or methods change in a way older versions can't handle
+// 2: compression is negotiated before rpc starts
+// 3: deltas carry checksums, and Delta returns the paths it rejected
+// 4: the index hash is negotiated, and the index has sizes and modification times
+// 5: binary and rsync deltas carry checksums too, and return the paths they rejected
+// 6: the client sends each save as one Commit
+const ProtocolVersion = 6
+
+// what -version prints and what the server binary is cached under
+// the protocol is part of it, so that a binary of the same Version that speaks
+// another protocol is never taken for the right one
+var FullVersion = Version + "-protocol" + strconv.Itoa(ProtocolVersion)
+
+const Server_Hello = "Server.Hello"
+
+// optional parts of the protocol, so a client can tell what the server can do
+const (
+	FeatureBinary  = "binary"
+	FeatureDeletes = "deletes"
+	FeatureRenames = "renames"
+	FeatureRsync   = "rsync"
+	FeatureModes   = "modes"
+	FeatureWatch   = "watch"
+	// zstd and gzip, see Compressions
+	FeatureCompression = "compression"
+	// the server follows the client's ignore config, see SetIgnoreConfig
+	FeatureIgnoreConfig = "ignore-config"
+)
+
+// what this version of the client needs and the server offers
+var Features = []string{
+	FeatureBinary,
+	FeatureDeletes,
+	FeatureRenames,
+	FeatureRsync,
+	FeatureModes,
+	FeatureWatch,
+	FeatureCompression,
+	FeatureIgnoreConfig,
+}
+
+type Hello struct {
+	ProtocolVersion int
+	Version         string
+	Features        []string
+	// the index hashes the client has, in order of preference
+	Hashes []string
+}
+
+type HelloReply struct {
+	ProtocolVersion int
+	Version         string
+	Features        []string
+	// the first of the client's hashes that the server has
+	Hash string
+	// which server and folder the client is talking to
+	Hostname string
+	Path     string
+}
+
+func (c *ServerConfig) Hello(hello Hello, reply *HelloReply) error {
+	hostname, _ := os.Hostname()
+	*reply = HelloReply{
+		ProtocolVersion: ProtocolVersion,
+		Version:         Version,
+		Features:        Features,
+		Hash:            pickHash(hello.Hashes),
+		Hostname:        hostname,
+		Path:            c.path,
+	}
+	log.Println("hello from client", hello.Version, "protocol", hello.ProtocolVersion, "hash", reply.Hash)
+	return nil
+}
+
+func hasFeature(features []string, feature string) bool {
+	for _, f := range features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// checks that the server speaks the same protocol before anything else is sent
+func (c *ClientFolder) Hello() error {
+	hello := Hello{
+		ProtocolVersion: ProtocolVersion,
+		Version:         Version,
+		Features:        Features,
+		Hashes:          c.hashes(),
+	}
+	reply := HelloReply{}
+	err := c.Client.Call(Server_Hello, hello, &reply)
+	if err != nil {
+		if IsConnectionError(err) {
+			return err
+		}
+		// servers from before the handshake don't know the method
+		return errors.Errorf("server sshsync is older than %s and can't be used with it (%s), "+
+			"install %s on the server or let the client upload itself by leaving out --server-command", Version, err, Version)
+	}
+
+	if reply.ProtocolVersion != ProtocolVersion {
+		return errors.Errorf("server %s runs sshsync %s with protocol %d, but this is %s with protocol %d, "+
+			"install %s on the server or let the client upload itself by leaving out --server-command",
+			reply.Hostname, reply.Version, reply.ProtocolVersion, Version, ProtocolVersion, Version)
+	}
+	missing := []string{}
+	for _, feature := range Features {
+		if !hasFeature(reply.Features, feature) {
+			missing = append(missing, feature)
+		}
+	}
+	if len(missing) > 0 {
+		return errors.Errorf("server %s runs sshsync %s, which does not support %s",
+			reply.Hostname, reply.Version, strings.Join(missing, ", "))
+	}
+	if reply.Hash == "" {
+		return errors.Errorf("server %s runs sshsync %s, which has none of the hashes %s",
+			reply.Hostname, reply.Version, strings.Join(c.hashes(), ", "))
+	}
+	c.ServerInfo = reply
+	log.Println("connected to sshsync", reply.Version, "on", reply.Hostname+":"+reply.Path, "hash", reply.Hash)
+	return nil
+}
@@ -0,0 +1,79 @@
+package sshsync_test
+
+import (
+	"github.com/Joshua-Wright/sshsync"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"net/rpc"
+	"testing"
+)
+
+func TestHello(t *testing.T) {
+	server := sshsync.NewServerConfig(afero.NewMemMapFs())
+	clientConn, serverConn := sshsync.TwoWayPipe()
+	go server.ReadCommands(serverConn)
+	c := &sshsync.ClientFolder{Client: rpc.NewClient(clientConn)}
+	defer c.Close()
+
+	assert.NoError(t, c.Hello())
+	assert.Equal(t, sshsync.Version, c.ServerInfo.Version)
+	assert.Equal(t, sshsync.ProtocolVersion, c.ServerInfo.ProtocolVersion)
+	assert.Equal(t, sshsync.Features, c.ServerInfo.Features)
+	assert.Equal(t, sshsync.Hashes[0], c.ServerInfo.Hash)
+}
+
+func TestHelloHash(t *testing.T) {
+	server := sshsync.NewServerConfig(afero.NewMemMapFs())
+	clientConn, serverConn := sshsync.TwoWayPipe()
+	go server.ReadCommands(serverConn)
+	c := &sshsync.ClientFolder{
+		Client: rpc.NewClient(clientConn),
+		// the server picks the first one it has
+		Hashes: []string{"md5", sshsync.HashSha256, sshsync.HashBlake3},
+	}
+	defer c.Close()
+	assert.NoError(t, c.Hello())
+	assert.Equal(t, sshsync.HashSha256, c.ServerInfo.Hash)
+
+	c.Hashes = []string{"md5"}
+	err := c.Hello()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "none of the hashes md5")
+	}
+}
+
+// a server from before the handshake
+type OldServer struct{}
+
+func (s *OldServer) GetFileHashes(_ int, index *map[string]uint64) error {
+	return nil
+}
+
+// a server with a newer protocol
+type NewerServer struct{}
+
+func (s *NewerServer) Hello(hello sshsync.Hello, reply *sshsync.HelloReply) error {
+	*reply = sshsync.HelloReply{
+		ProtocolVersion: sshsync.ProtocolVersion + 1,
+		Version:         "99.0.0",
+		Hostname:        "build-01",
+	}
+	return nil
+}
+
+func TestHelloIncompatible(t *testing.T) {
+	for _, server := range []interface{}{&OldServer{}, &NewerServer{}} {
+		rpcServer := rpc.NewServer()
+		assert.NoError(t, rpcServer.RegisterName("Server", server))
+		clientConn, serverConn := sshsync.TwoWayPipe()
+		go rpcServer.ServeConn(serverConn)
+		c := &sshsync.ClientFolder{Client: rpc.NewClient(clientConn)}
+
+		err := c.Hello()
+		if assert.Error(t, err) {
+			// says what to do about it
+			assert.Contains(t, err.Error(), "install "+sshsync.Version+" on the server")
+		}
+		c.Close()
+	}
+}
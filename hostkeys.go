@@ -0,0 +1,199 @@
+package sshsync
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// what to do with a server whose key is not in known_hosts yet
+type HostKeyChecking int
+
+const (
+	// ask on the terminal whether to trust the key (trust on first use)
+	HostKeyAsk HostKeyChecking = iota
+	// trust and remember unknown keys without asking
+	HostKeyAcceptNew
+	// only connect to servers that are already in known_hosts
+	HostKeyStrict
+)
+
+var hostKeyCheckingNames = map[string]HostKeyChecking{
+	"ask":        HostKeyAsk,
+	"accept-new": HostKeyAcceptNew,
+	"strict":     HostKeyStrict,
+}
+
+func ParseHostKeyChecking(name string) (HostKeyChecking, error) {
+	checking, ok := hostKeyCheckingNames[name]
+	if !ok {
+		return HostKeyAsk, errors.New("unknown host key checking: " + name)
+	}
+	return checking, nil
+}
+
+func DefaultKnownHostsFile() string {
+	return filepath.Join(os.Getenv("HOME"), ".ssh", "known_hosts")
+}
+
+// checks server keys against known_hosts files, hashed entries included
+// a key that doesn't match the known one is always an error, whatever Checking is
+type HostKeyVerifier struct {
+	// new keys are added to the first file, files that don't exist are skipped
+	KnownHostsFiles []string
+	Checking        HostKeyChecking
+	// asks the user a yes/no question, nil asks on stdin
+	Prompt func(question string) (bool, error)
+}
+
+func NewHostKeyVerifier(checking HostKeyChecking, knownHostsFiles ...string) *HostKeyVerifier {
+	if len(knownHostsFiles) == 0 {
+		knownHostsFiles = []string{DefaultKnownHostsFile()}
+	}
+	return &HostKeyVerifier{
+		KnownHostsFiles: knownHostsFiles,
+		Checking:        checking,
+	}
+}
+
+// knownhosts fails on files that don't exist, which is normal before the first connection
+func (v *HostKeyVerifier) knownHosts() (ssh.HostKeyCallback, error) {
+	files := []string{}
+	for _, file := range v.KnownHostsFiles {
+		if _, err := os.Stat(file); err == nil {
+			files = append(files, file)
+		}
+	}
+	return knownhosts.New(files...)
+}
+
+func (v *HostKeyVerifier) HostKeyCallback() ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		check, err := v.knownHosts()
+		if err != nil {
+			return errors.Wrap(err, "read known_hosts")
+		}
+		err = check(hostname, remote, key)
+		if err == nil {
+			return nil
+		}
+
+		var keyErr *knownhosts.KeyError
+		if revokedErr, ok := err.(*knownhosts.RevokedError); ok {
+			return errors.Errorf("host key %s %s for %s is revoked (%s:%d)",
+				key.Type(), ssh.FingerprintSHA256(key), hostname, revokedErr.Revoked.Filename, revokedErr.Revoked.Line)
+		} else if keyErr, ok = err.(*knownhosts.KeyError); !ok {
+			return err
+		}
+
+		if len(keyErr.Want) > 0 {
+			known := []string{}
+			for _, want := range keyErr.Want {
+				known = append(known, fmt.Sprintf("%s %s (%s:%d)",
+					want.Key.Type(), ssh.FingerprintSHA256(want.Key), want.Filename, want.Line))
+			}
+			return errors.Errorf("host key mismatch for %s, someone could be impersonating it\nserver sent: %s %s\nknown_hosts has: %s",
+				hostname, key.Type(), ssh.FingerprintSHA256(key), strings.Join(known, ", "))
+		}
+		return v.unknownHost(hostname, key)
+	}
+}
+
+func (v *HostKeyVerifier) unknownHost(hostname string, key ssh.PublicKey) error {
+	fingerprint := key.Type() + " " + ssh.FingerprintSHA256(key)
+	switch v.Checking {
+	case HostKeyStrict:
+		return errors.Errorf("%s is not in known_hosts, host key is %s", hostname, fingerprint)
+	case HostKeyAsk:
+		prompt := v.Prompt
+		if prompt == nil {
+			prompt = promptStdin
+		}
+		trust, err := prompt(fmt.Sprintf("The authenticity of host %s can't be established.\nkey fingerprint is %s\nAre you sure you want to continue connecting (yes/no)? ",
+			hostname, fingerprint))
+		if err != nil {
+			return err
+		}
+		if !trust {
+			return errors.Errorf("host key for %s was not accepted: %s", hostname, fingerprint)
+		}
+	}
+	return v.addKnownHost(hostname, key)
+}
+
+func (v *HostKeyVerifier) addKnownHost(hostname string, key ssh.PublicKey) error {
+	if len(v.KnownHostsFiles) == 0 {
+		return nil
+	}
+	file := v.KnownHostsFiles[0]
+	err := os.MkdirAll(filepath.Dir(file), 0700)
+	if err != nil {
+		return err
+	}
+	fp, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	_, err = fmt.Fprintln(fp, knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key))
+	if err == nil {
+		log.Println("added host key for", hostname, "to", file)
+	}
+	return err
+}
+
+// key types known for address, so the server offers one of those instead of one we have never seen
+func (v *HostKeyVerifier) HostKeyAlgorithms(address string) []string {
+	check, err := v.knownHosts()
+	if err != nil {
+		return nil
+	}
+	// the error for a key that is not known lists the ones that are
+	err = check(address, &net.TCPAddr{}, unknownPublicKey{})
+	keyErr, ok := err.(*knownhosts.KeyError)
+	if !ok {
+		return nil
+	}
+	algorithms := []string{}
+	seen := make(map[string]bool)
+	for _, want := range keyErr.Want {
+		keyType := want.Key.Type()
+		if seen[keyType] {
+			continue
+		}
+		seen[keyType] = true
+		if keyType == ssh.KeyAlgoRSA {
+			// rsa keys sign with sha2 on any recent server
+			algorithms = append(algorithms, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256)
+		}
+		algorithms = append(algorithms, keyType)
+	}
+	return algorithms
+}
+
+// never matches a known key
+type unknownPublicKey struct{}
+
+func (unknownPublicKey) Type() string    { return "unknown" }
+func (unknownPublicKey) Marshal() []byte { return []byte("unknown") }
+func (unknownPublicKey) Verify(data []byte, sig *ssh.Signature) error {
+	return errors.New("unknown key")
+}
+
+func promptStdin(question string) (bool, error) {
+	fmt.Fprint(os.Stderr, question)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false, err
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "yes" || answer == "y", nil
+}
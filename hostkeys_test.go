@@ -0,0 +1,78 @@
+package sshsync_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"github.com/Joshua-Wright/sshsync"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newHostKey(t *testing.T) ssh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	key, err := ssh.NewPublicKey(pub)
+	assert.NoError(t, err)
+	return key
+}
+
+func TestHostKeyVerifier(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestHostKeyVerifier")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	knownHostsFile := filepath.Join(dir, "known_hosts")
+
+	knownKey := newHostKey(t)
+	otherKey := newHostKey(t)
+	remote := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 22}
+	// hashed like HashKnownHosts does
+	line := knownhosts.Line([]string{knownhosts.HashHostname("known.example.com")}, knownKey)
+	assert.NoError(t, ioutil.WriteFile(knownHostsFile, []byte(line+"\n"), 0600))
+
+	v := sshsync.NewHostKeyVerifier(sshsync.HostKeyStrict, knownHostsFile)
+	check := v.HostKeyCallback()
+	assert.NoError(t, check("known.example.com:22", remote, knownKey))
+
+	// a different key is an error that shows the fingerprint
+	err = check("known.example.com:22", remote, otherKey)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), ssh.FingerprintSHA256(otherKey))
+		assert.Contains(t, err.Error(), ssh.FingerprintSHA256(knownKey))
+	}
+
+	// unknown hosts fail in strict mode
+	assert.Error(t, check("new.example.com:22", remote, otherKey))
+
+	// and are only added when the user says yes
+	v.Checking = sshsync.HostKeyAsk
+	questions := 0
+	v.Prompt = func(question string) (bool, error) {
+		questions++
+		assert.Contains(t, question, ssh.FingerprintSHA256(otherKey))
+		return false, nil
+	}
+	assert.Error(t, check("new.example.com:22", remote, otherKey))
+	v.Prompt = func(question string) (bool, error) {
+		questions++
+		return true, nil
+	}
+	assert.NoError(t, check("new.example.com:22", remote, otherKey))
+	assert.Equal(t, 2, questions)
+
+	// remembered after that
+	assert.NoError(t, check("new.example.com:22", remote, otherKey))
+	assert.Equal(t, 2, questions)
+	assert.Equal(t, []string{ssh.KeyAlgoED25519}, v.HostKeyAlgorithms("new.example.com:22"))
+
+	// accept-new doesn't ask
+	v.Checking = sshsync.HostKeyAcceptNew
+	v.Prompt = nil
+	assert.NoError(t, check("other.example.com:2222", remote, knownKey))
+	assert.Error(t, check("other.example.com:2222", remote, otherKey))
+}
@@ -0,0 +1,55 @@
+package sshsync
+
+import (
+	"golang.org/x/crypto/ssh"
+	"log"
+	"time"
+)
+
+const keepAliveRequest = "keepalive@openssh.com"
+
+// like ServerAliveInterval and ServerAliveCountMax of ssh
+type KeepAliveConfig struct {
+	// 0 turns keepalives off
+	Interval time.Duration
+	// unanswered keepalives in a row before the connection counts as dead
+	MaxMissed int
+}
+
+// sends keepalives on conn until it is closed
+// a half open connection never answers, so conn is closed after cfg.MaxMissed
+// unanswered keepalives, which makes everything waiting on it fail instead of hang
+func StartKeepAlive(conn ssh.Conn, cfg KeepAliveConfig) {
+	if cfg.Interval <= 0 {
+		return
+	}
+	go func() {
+		missed := 0
+		for {
+			time.Sleep(cfg.Interval)
+			reply := make(chan error, 1)
+			go func() {
+				// servers that don't know the request still answer it with a failure
+				_, _, err := conn.SendRequest(keepAliveRequest, true, nil)
+				reply <- err
+			}()
+
+			select {
+			case err := <-reply:
+				if err != nil {
+					// closed
+					return
+				}
+				missed = 0
+			case <-time.After(cfg.Interval):
+				missed++
+				log.Println("no answer to keepalive", missed, "of", cfg.MaxMissed)
+				if missed >= cfg.MaxMissed {
+					log.Println("server stopped answering, closing connection")
+					conn.Close()
+					return
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,46 @@
+package sshsync_test
+
+import (
+	"github.com/Joshua-Wright/sshsync"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"testing"
+	"time"
+)
+
+func TestKeepAlive(t *testing.T) {
+	priv, pub := newUserKey(t)
+	server := startSshServer(t, pub)
+	defer server.Stop()
+	signer, err := ssh.NewSignerFromKey(priv)
+	assert.NoError(t, err)
+
+	client, err := ssh.Dial("tcp", server.Address, &ssh.ClientConfig{
+		User:            "user",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.FixedHostKey(server.HostKey),
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	closed := make(chan bool)
+	go func() {
+		client.Wait()
+		close(closed)
+	}()
+	sshsync.StartKeepAlive(client, sshsync.KeepAliveConfig{Interval: 20 * time.Millisecond, MaxMissed: 2})
+
+	// answered keepalives keep it open
+	select {
+	case <-closed:
+		t.Fatal("connection closed while the server answers")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	server.Hang()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection still open after the server stopped answering")
+	}
+}
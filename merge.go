@@ -0,0 +1,286 @@
+package sshsync
+
+import (
+	"bytes"
+	"github.com/pkg/errors"
+	"github.com/sergi/go-diff/diffmatchpatch"
+	"github.com/spf13/afero"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// what to do with a file that changed on both the client and the server
+type ConflictPolicy int
+
+const (
+	// report the conflict and leave both sides alone
+	ConflictManual ConflictPolicy = iota
+	ConflictClientWins
+	ConflictServerWins
+	// three-way merge, with conflict markers where both sides changed the same lines
+	ConflictMerge
+)
+
+var conflictPolicyNames = map[string]ConflictPolicy{
+	"manual":      ConflictManual,
+	"client-wins": ConflictClientWins,
+	"server-wins": ConflictServerWins,
+	"merge":       ConflictMerge,
+}
+
+func ParseConflictPolicy(name string) (ConflictPolicy, error) {
+	policy, ok := conflictPolicyNames[name]
+	if !ok {
+		return ConflictManual, errors.New("unknown conflict policy: " + name)
+	}
+	return policy, nil
+}
+
+const (
+	conflictStart  = "<<<<<<< client\n"
+	conflictMiddle = "=======\n"
+	conflictEnd    = ">>>>>>> server\n"
+)
+
+// binary files that can't be merged keep the server's version next to the client's
+const conflictCopySuffix = ".sshsync-server"
+
+// splits after every newline, so that joining the lines gives back text
+func splitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// for every line of a, the index of the same line in b, or -1 if it was removed
+func matchLines(a, b string) []int {
+	// diffmatchpatch diffs lines by turning every line into a single rune
+	runesA, runesB, _ := dmp.DiffLinesToRunes(a, b)
+	diffs := dmp.DiffMainRunes(runesA, runesB, false)
+
+	matches := make([]int, len(runesA))
+	i, j := 0, 0
+	for _, diff := range diffs {
+		n := utf8.RuneCountInString(diff.Text)
+		switch diff.Type {
+		case diffmatchpatch.DiffEqual:
+			for k := 0; k < n; k++ {
+				matches[i+k] = j + k
+			}
+			i += n
+			j += n
+		case diffmatchpatch.DiffDelete:
+			for k := 0; k < n; k++ {
+				matches[i+k] = -1
+			}
+			i += n
+		case diffmatchpatch.DiffInsert:
+			j += n
+		}
+	}
+	return matches
+}
+
+func sameLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func writeLines(buf *bytes.Buffer, lines []string) {
+	for _, line := range lines {
+		buf.WriteString(line)
+	}
+}
+
+// conflict markers have to start on their own line
+func writeConflictLines(buf *bytes.Buffer, lines []string) {
+	writeLines(buf, lines)
+	if len(lines) > 0 && !strings.HasSuffix(lines[len(lines)-1], "\n") {
+		buf.WriteString("\n")
+	}
+}
+
+// line based three-way merge of the client's and server's changes since base
+// clean is false if both changed the same lines, which are then surrounded by conflict markers
+func MergeText(base, ours, theirs string) (merged string, clean bool) {
+	baseLines := splitLines(base)
+	oursLines := splitLines(ours)
+	theirsLines := splitLines(theirs)
+	toOurs := matchLines(base, ours)
+	toTheirs := matchLines(base, theirs)
+
+	buf := &bytes.Buffer{}
+	clean = true
+	i, j, k := 0, 0, 0
+	for {
+		// lines that are the same everywhere
+		for i < len(baseLines) && toOurs[i] == j && toTheirs[i] == k {
+			buf.WriteString(baseLines[i])
+			i++
+			j++
+			k++
+		}
+		if i == len(baseLines) && j == len(oursLines) && k == len(theirsLines) {
+			break
+		}
+
+		// everything up to the next line that is still in both is a changed chunk
+		nextI := i
+		for nextI < len(baseLines) && (toOurs[nextI] == -1 || toTheirs[nextI] == -1) {
+			nextI++
+		}
+		nextJ, nextK := len(oursLines), len(theirsLines)
+		if nextI < len(baseLines) {
+			nextJ, nextK = toOurs[nextI], toTheirs[nextI]
+		}
+
+		baseChunk := baseLines[i:nextI]
+		oursChunk := oursLines[j:nextJ]
+		theirsChunk := theirsLines[k:nextK]
+		switch {
+		case sameLines(oursChunk, baseChunk):
+			writeLines(buf, theirsChunk)
+		case sameLines(theirsChunk, baseChunk), sameLines(oursChunk, theirsChunk):
+			writeLines(buf, oursChunk)
+		default:
+			clean = false
+			buf.WriteString(conflictStart)
+			writeConflictLines(buf, oursChunk)
+			buf.WriteString(conflictMiddle)
+			writeConflictLines(buf, theirsChunk)
+			buf.WriteString(conflictEnd)
+		}
+		i, j, k = nextI, nextJ, nextK
+	}
+	return buf.String(), clean
+}
+
+// bases are the last content the client and server agreed on, kept in BaseFs
+// under the same paths as the synced files
+
+func (c *ClientFolder) baseFs() afero.Fs {
+	if c.BaseFs == nil {
+		c.BaseFs = afero.NewMemMapFs()
+	}
+	return c.BaseFs
+}
+
+func (c *ClientFolder) loadBase(path string) (string, bool) {
+	buf, err := afero.ReadFile(c.baseFs(), path)
+	if err != nil {
+		return "", false
+	}
+	return string(buf), true
+}
+
+// failing to save a base only makes the next conflict harder to merge,
+// so errors are logged instead of failing the sync
+func (c *ClientFolder) saveBase(path, content string) {
+	if base, ok := c.loadBase(path); ok && base == content {
+		return
+	}
+	err := c.baseFs().MkdirAll(filepath.Dir(path), 0755)
+	if err == nil {
+		err = afero.WriteFile(c.baseFs(), path, []byte(content), 0644)
+	}
+	if err != nil {
+		log.Println("failed to save base", path, err)
+	}
+}
+
+func (c *ClientFolder) removeBase(path string) {
+	err := c.baseFs().Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		log.Println("failed to remove base", path, err)
+	}
+}
+
+// moves the bases of a renamed file, or of everything in a renamed folder
+func (c *ClientFolder) renameBase(oldPath, newPath string) {
+	paths := []string{}
+	afero.Walk(c.baseFs(), oldPath, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	for _, path := range paths {
+		base, ok := c.loadBase(path)
+		if !ok {
+			continue
+		}
+		renamed, _ := renamedPath(path, oldPath, newPath)
+		c.saveBase(renamed, base)
+		c.removeBase(path)
+	}
+}
+
+// writes content the server has to disk and the cache, and makes it the base
+func (c *ClientFolder) writeLocalFile(path, content string, meta FileMeta) error {
+	if c.TouchModTime {
+		meta.ModTime = time.Time{}
+	}
+	c.FileCache[path] = content
+	err := c.ClientFs.MkdirAll(filepath.Dir(path), 0755)
+	if err == nil {
+		err = writeFile(c.ClientFs, path, []byte(content), meta)
+	}
+	if err != nil {
+		return err
+	}
+	c.saveBase(path, content)
+	return nil
+}
+
+// the server's version next to the client's, left out of the cache because
+// conflict copies are never synced
+func (c *ClientFolder) writeConflictCopy(serverFile TextFile) error {
+	copyPath := serverFile.Path + conflictCopySuffix
+	log.Println("conflict, keeping server version as", copyPath)
+	meta := serverFile.FileMeta
+	if c.TouchModTime {
+		meta.ModTime = time.Time{}
+	}
+	return writeFile(c.ClientFs, copyPath, []byte(serverFile.Content), meta)
+}
+
+func (c *ClientFolder) removeLocalFile(path string) error {
+	delete(c.FileCache, path)
+	c.removeBase(path)
+	err := c.ClientFs.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// bases live in the user's cache folder, one folder per pair of synced folders
+func openBaseFs(remote, local string) (afero.Fs, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	absLocal, err := filepath.Abs(local)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(cacheDir, "sshsync", "bases", crc64string(remote+"\n"+absLocal))
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return afero.NewBasePathFs(afero.NewOsFs(), dir), nil
+}
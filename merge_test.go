@@ -0,0 +1,60 @@
+package sshsync_test
+
+import (
+	"github.com/Joshua-Wright/sshsync"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestMergeText(t *testing.T) {
+	base := "one\ntwo\nthree\nfour\nfive\n"
+
+	// changes to different lines merge cleanly
+	merged, clean := sshsync.MergeText(base,
+		"ONE\ntwo\nthree\nfour\nfive\n",
+		"one\ntwo\nthree\nfour\nFIVE\n")
+	assert.True(t, clean)
+	assert.Equal(t, "ONE\ntwo\nthree\nfour\nFIVE\n", merged)
+
+	// insertions and deletions on different sides
+	merged, clean = sshsync.MergeText(base,
+		"one\ntwo\ninserted\nthree\nfour\nfive\n",
+		"one\ntwo\nthree\nfive\n")
+	assert.True(t, clean)
+	assert.Equal(t, "one\ntwo\ninserted\nthree\nfive\n", merged)
+
+	// the same change on both sides is not a conflict
+	merged, clean = sshsync.MergeText(base,
+		"one\n2\nthree\nfour\nfive\n",
+		"one\n2\nthree\nfour\nfive\n")
+	assert.True(t, clean)
+	assert.Equal(t, "one\n2\nthree\nfour\nfive\n", merged)
+
+	// missing trailing newline is kept
+	merged, clean = sshsync.MergeText("a\nb", "A\nb", "a\nb")
+	assert.True(t, clean)
+	assert.Equal(t, "A\nb", merged)
+
+	// different changes to the same line conflict
+	merged, clean = sshsync.MergeText(base,
+		"one\nclient\nthree\nfour\nfive\n",
+		"one\nserver\nthree\nfour\nFIVE\n")
+	assert.False(t, clean)
+	assert.Equal(t, "one\n<<<<<<< client\nclient\n=======\nserver\n>>>>>>> server\nthree\nfour\nFIVE\n", merged)
+
+	// without a base everything that differs conflicts
+	merged, clean = sshsync.MergeText("", "client", "server")
+	assert.False(t, clean)
+	assert.Equal(t, "<<<<<<< client\nclient\n=======\nserver\n>>>>>>> server\n", merged)
+}
+
+func TestParseConflictPolicy(t *testing.T) {
+	policy, err := sshsync.ParseConflictPolicy("merge")
+	assert.NoError(t, err)
+	assert.Equal(t, sshsync.ConflictMerge, policy)
+	policy, err = sshsync.ParseConflictPolicy("client-wins")
+	assert.NoError(t, err)
+	assert.Equal(t, sshsync.ConflictClientWins, policy)
+	_, err = sshsync.ParseConflictPolicy("whatever")
+	assert.Error(t, err)
+}
@@ -0,0 +1,67 @@
+package sshsync
+
+import (
+	"sort"
+	"sync"
+)
+
+// a lock for every path in use, so that writes to different files don't wait for
+// each other, while two writes to the same file still happen one after the other
+// the zero value is ready to use
+type pathLocks struct {
+	mu    sync.Mutex
+	locks map[string]*pathLock
+}
+
+type pathLock struct {
+	sync.Mutex
+	// how many callers hold or wait for it, it is dropped from the map at 0
+	refs int
+}
+
+// locks all paths, in sorted order so that two callers with overlapping paths
+// can't each hold what the other one waits for
+func (l *pathLocks) Lock(paths ...string) (unlock func()) {
+	sorted := make([]string, 0, len(paths))
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		if !seen[path] {
+			seen[path] = true
+			sorted = append(sorted, path)
+		}
+	}
+	sort.Strings(sorted)
+
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*pathLock)
+	}
+	held := make([]*pathLock, len(sorted))
+	for i, path := range sorted {
+		lock, ok := l.locks[path]
+		if !ok {
+			lock = &pathLock{}
+			l.locks[path] = lock
+		}
+		lock.refs++
+		held[i] = lock
+	}
+	l.mu.Unlock()
+
+	for _, lock := range held {
+		lock.Lock()
+	}
+	return func() {
+		for _, lock := range held {
+			lock.Unlock()
+		}
+		l.mu.Lock()
+		for i, lock := range held {
+			lock.refs--
+			if lock.refs == 0 {
+				delete(l.locks, sorted[i])
+			}
+		}
+		l.mu.Unlock()
+	}
+}
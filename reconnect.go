@@ -0,0 +1,75 @@
+package sshsync
+
+import (
+	"github.com/pkg/errors"
+	"io"
+	"log"
+	"net"
+	"net/rpc"
+	"time"
+)
+
+const (
+	reconnectMinDelay = time.Second
+	reconnectMaxDelay = time.Minute
+)
+
+// whether err means the connection to the server is gone, as opposed to
+// the server refusing a single call
+func IsConnectionError(err error) bool {
+	switch errors.Cause(err) {
+	case nil:
+		return false
+	case rpc.ErrShutdown, io.EOF, io.ErrUnexpectedEOF, io.ErrClosedPipe:
+		return true
+	}
+	_, isNetError := errors.Cause(err).(net.Error)
+	return isNetError
+}
+
+// doubles the delay between attempts, up to reconnectMaxDelay
+func nextReconnectDelay(delay time.Duration) time.Duration {
+	delay *= 2
+	if delay > reconnectMaxDelay {
+		delay = reconnectMaxDelay
+	}
+	return delay
+}
+
+// dials the server again and brings it up to date
+// edits that were queued or only half sent when the connection dropped are found
+// by comparing the whole folder with the server, like when starting up
+func (c *ClientFolder) Reconnect() error {
+	if c.Dial == nil {
+		return errors.New("no way to reconnect to the server")
+	}
+	if c.Client != nil {
+		c.Client.Close()
+		c.Client = nil
+	}
+	conn, err := c.Dial()
+	if err != nil {
+		return err
+	}
+	c.Client = rpc.NewClient(conn)
+	log.Println("reconnected to server")
+	// the server may have been replaced by another version in the meantime,
+	// which counts as not connected so that it is tried again later
+	err = c.Hello()
+	if err != nil {
+		c.Client.Close()
+		c.Client = nil
+		return err
+	}
+	err = c.SendIgnoreConfig()
+	if err != nil {
+		return err
+	}
+
+	c.FileCache = make(map[string]string)
+	err = c.BuildCache()
+	if err != nil {
+		return err
+	}
+	return c.AutoResolveWithServer()
+}
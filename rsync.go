@@ -0,0 +1,233 @@
+package sshsync
+
+import (
+	"bytes"
+	"crypto/md5"
+	"github.com/pkg/errors"
+)
+
+// files bigger than this are sent with rsync deltas instead of diffmatchpatch
+const DefaultRsyncThreshold = 1 << 20
+
+const (
+	minRsyncBlockSize = 1 << 10
+	maxRsyncBlockSize = 1 << 17
+)
+
+// weak rolling checksum and strong hash of one block of a file
+type BlockSignature struct {
+	Weak   uint32
+	Strong [md5.Size]byte
+}
+
+// sent by the server, so that the client can find blocks the server already has
+type FileSignature struct {
+	Path      string
+	Size      int
+	BlockSize int
+	Blocks    []BlockSignature
+	// crc64 of the whole content, for RsyncDelta.BaseChecksum
+	Checksum uint64
+}
+
+// copies Count blocks of the old content starting at Block,
+// or inserts Literal if Count is 0
+type RsyncOp struct {
+	Block   int
+	Count   int
+	Literal []byte
+}
+
+type RsyncDelta struct {
+	Path      string
+	BlockSize int
+	Ops       []RsyncOp
+	// crc64 of the content the signature was made from, and of the result
+	BaseChecksum   uint64
+	ResultChecksum uint64
+	FileMeta
+}
+type RsyncDeltas []RsyncDelta
+
+// roughly the square root of the file size, like rsync
+func rsyncBlockSize(size int) int {
+	blockSize := minRsyncBlockSize
+	for blockSize*blockSize < size && blockSize < maxRsyncBlockSize {
+		blockSize *= 2
+	}
+	return blockSize
+}
+
+// checksum from rsync, where a is the sum of the bytes and b is the sum of a
+// over the window. both are kept mod 2^16 by the final mask
+type rollingChecksum struct {
+	a, b uint32
+	n    uint32
+}
+
+func newRollingChecksum(block []byte) rollingChecksum {
+	r := rollingChecksum{n: uint32(len(block))}
+	for i, x := range block {
+		r.a += uint32(x)
+		r.b += uint32(len(block)-i) * uint32(x)
+	}
+	return r
+}
+
+// slides the window one byte forward
+func (r *rollingChecksum) roll(out, in byte) {
+	r.a = r.a - uint32(out) + uint32(in)
+	r.b = r.b - r.n*uint32(out) + r.a
+}
+
+func (r rollingChecksum) sum() uint32 {
+	return r.a&0xffff | r.b<<16
+}
+
+func ComputeSignature(path string, content []byte, blockSize int) FileSignature {
+	sig := FileSignature{
+		Path:      path,
+		Size:      len(content),
+		BlockSize: blockSize,
+		Blocks:    make([]BlockSignature, 0, len(content)/blockSize+1),
+		Checksum:  crc64checksum(string(content)),
+	}
+	for start := 0; start < len(content); start += blockSize {
+		end := start + blockSize
+		if end > len(content) {
+			end = len(content)
+		}
+		block := content[start:end]
+		checksum := newRollingChecksum(block)
+		sig.Blocks = append(sig.Blocks, BlockSignature{
+			Weak:   checksum.sum(),
+			Strong: md5.Sum(block),
+		})
+	}
+	return sig
+}
+
+// appends a copy of block, merging it with the previous op where possible
+func appendRsyncCopy(ops []RsyncOp, block int) []RsyncOp {
+	if len(ops) > 0 {
+		last := &ops[len(ops)-1]
+		if last.Count > 0 && last.Block+last.Count == block {
+			last.Count++
+			return ops
+		}
+	}
+	return append(ops, RsyncOp{Block: block, Count: 1})
+}
+
+func appendRsyncLiteral(ops []RsyncOp, literal []byte) []RsyncOp {
+	if len(literal) == 0 {
+		return ops
+	}
+	return append(ops, RsyncOp{Literal: literal})
+}
+
+// finds the blocks of sig in content, and sends everything else as literals
+func ComputeRsyncDelta(sig FileSignature, content []byte) RsyncDelta {
+	delta := RsyncDelta{
+		Path:           sig.Path,
+		BlockSize:      sig.BlockSize,
+		BaseChecksum:   sig.Checksum,
+		ResultChecksum: crc64checksum(string(content)),
+	}
+	blockSize := sig.BlockSize
+
+	// only full size blocks can be found with the rolling checksum,
+	// a short last block is checked against the end of the content separately
+	lastBlock := len(sig.Blocks) - 1
+	lastBlockSize := sig.Size - lastBlock*blockSize
+	byWeak := make(map[uint32][]int)
+	for i, block := range sig.Blocks {
+		if i == lastBlock && lastBlockSize < blockSize {
+			break
+		}
+		byWeak[block.Weak] = append(byWeak[block.Weak], i)
+	}
+
+	literalStart := 0
+	i := 0
+	var checksum rollingChecksum
+	if i+blockSize <= len(content) {
+		checksum = newRollingChecksum(content[i : i+blockSize])
+	}
+	for i+blockSize <= len(content) {
+		matched := -1
+		if candidates, ok := byWeak[checksum.sum()]; ok {
+			strong := md5.Sum(content[i : i+blockSize])
+			for _, candidate := range candidates {
+				if sig.Blocks[candidate].Strong == strong {
+					matched = candidate
+					break
+				}
+			}
+		}
+
+		if matched != -1 {
+			delta.Ops = appendRsyncLiteral(delta.Ops, content[literalStart:i])
+			delta.Ops = appendRsyncCopy(delta.Ops, matched)
+			i += blockSize
+			literalStart = i
+			if i+blockSize <= len(content) {
+				checksum = newRollingChecksum(content[i : i+blockSize])
+			}
+			continue
+		}
+
+		if i+blockSize == len(content) {
+			break
+		}
+		checksum.roll(content[i], content[i+blockSize])
+		i++
+	}
+
+	// look for the short block in what is left, which is usually where it ends up
+	// after appending to a file
+	if lastBlock >= 0 && lastBlockSize < blockSize && len(content)-literalStart >= lastBlockSize {
+		last := sig.Blocks[lastBlock]
+		i = literalStart
+		checksum = newRollingChecksum(content[i : i+lastBlockSize])
+		for {
+			if checksum.sum() == last.Weak && md5.Sum(content[i:i+lastBlockSize]) == last.Strong {
+				delta.Ops = appendRsyncLiteral(delta.Ops, content[literalStart:i])
+				delta.Ops = appendRsyncCopy(delta.Ops, lastBlock)
+				literalStart = i + lastBlockSize
+				break
+			}
+			if i+lastBlockSize == len(content) {
+				break
+			}
+			checksum.roll(content[i], content[i+lastBlockSize])
+			i++
+		}
+	}
+
+	delta.Ops = appendRsyncLiteral(delta.Ops, content[literalStart:])
+	return delta
+}
+
+func ApplyRsyncDelta(oldContent []byte, delta RsyncDelta) ([]byte, error) {
+	if delta.BlockSize <= 0 {
+		return nil, errors.New("bad rsync block size for " + delta.Path)
+	}
+	newContent := bytes.Buffer{}
+	for _, op := range delta.Ops {
+		if op.Count == 0 {
+			newContent.Write(op.Literal)
+			continue
+		}
+		start := op.Block * delta.BlockSize
+		end := (op.Block + op.Count) * delta.BlockSize
+		if end > len(oldContent) {
+			end = len(oldContent)
+		}
+		if op.Block < 0 || op.Count < 0 || start >= end {
+			return nil, errors.New("rsync delta does not fit " + delta.Path)
+		}
+		newContent.Write(oldContent[start:end])
+	}
+	return newContent.Bytes(), nil
+}
@@ -0,0 +1,70 @@
+package sshsync_test
+
+import (
+	"bytes"
+	"github.com/Joshua-Wright/sshsync"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"testing"
+)
+
+func randomBytes(r *rand.Rand, n int) []byte {
+	buf := make([]byte, n)
+	r.Read(buf)
+	return buf
+}
+
+func literalSize(delta sshsync.RsyncDelta) int {
+	size := 0
+	for _, op := range delta.Ops {
+		size += len(op.Literal)
+	}
+	return size
+}
+
+func TestRsyncDelta(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	blockSize := 64
+	// not a multiple of the block size, so the last block is short
+	original := randomBytes(r, 64*50+17)
+
+	cases := map[string][]byte{
+		"unchanged":       original,
+		"empty":           {},
+		"from scratch":    randomBytes(r, 1000),
+		"insert in block": append(append(append([]byte{}, original[:1000]...), []byte("inserted")...), original[1000:]...),
+		"delete":          append(append([]byte{}, original[:500]...), original[900:]...),
+		"append":          append(append([]byte{}, original...), []byte("appended")...),
+		"prepend":         append([]byte("prepended"), original...),
+		"truncate":        original[:64*10+3],
+		"reorder":         append(append([]byte{}, original[64*25:]...), original[:64*25]...),
+	}
+	for name, newContent := range cases {
+		sig := sshsync.ComputeSignature("file.bin", original, blockSize)
+		delta := sshsync.ComputeRsyncDelta(sig, newContent)
+		result, err := sshsync.ApplyRsyncDelta(original, delta)
+		assert.NoError(t, err, name)
+		assert.True(t, bytes.Equal(newContent, result), name)
+	}
+
+	// only the changed parts are sent as literals
+	sig := sshsync.ComputeSignature("file.bin", original, blockSize)
+	assert.Equal(t, 0, literalSize(sshsync.ComputeRsyncDelta(sig, cases["unchanged"])))
+	// the short last block is only found after the last full block
+	assert.Equal(t, 17, literalSize(sshsync.ComputeRsyncDelta(sig, cases["reorder"])))
+	assert.Equal(t, len("appended"), literalSize(sshsync.ComputeRsyncDelta(sig, cases["append"])))
+	assert.Equal(t, len("prepended"), literalSize(sshsync.ComputeRsyncDelta(sig, cases["prepend"])))
+	assert.True(t, literalSize(sshsync.ComputeRsyncDelta(sig, cases["insert in block"])) < 2*blockSize)
+
+	// unchanged content is a single copy of every block
+	assert.Equal(t, []sshsync.RsyncOp{{Block: 0, Count: 51}}, sshsync.ComputeRsyncDelta(sig, original).Ops)
+}
+
+func TestApplyRsyncDeltaBadBlock(t *testing.T) {
+	_, err := sshsync.ApplyRsyncDelta([]byte("short"), sshsync.RsyncDelta{
+		Path:      "file.bin",
+		BlockSize: 64,
+		Ops:       []sshsync.RsyncOp{{Block: 3, Count: 1}},
+	})
+	assert.Error(t, err)
+}
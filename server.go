@@ -8,6 +8,11 @@ import (
 	"net/rpc"
 	"bufio"
 	"strings"
+	"path/filepath"
+	"sync"
+	"time"
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
 )
 
 const (
@@ -17,22 +22,60 @@ const (
 	Server_SendTextFile  = "Server.SendTextFile"
 	Server_SendTextFiles = "Server.SendTextFiles"
 	Server_Delta         = "Server.Delta"
+	Server_DeleteFiles   = "Server.DeleteFiles"
+	Server_Rename        = "Server.Rename"
+	Server_Commit        = "Server.Commit"
+
+	Server_SendBinaryFiles = "Server.SendBinaryFiles"
+	Server_BinaryDelta     = "Server.BinaryDelta"
+
+	Server_GetSignatures = "Server.GetSignatures"
+	Server_RsyncDelta    = "Server.RsyncDelta"
+
+	Server_GetFileModes = "Server.GetFileModes"
+	Server_Chmod        = "Server.Chmod"
+
+	Server_PollChanges = "Server.PollChanges"
 )
 
+// how long PollChanges waits for something to happen before returning nothing
+const pollTimeout = 30 * time.Second
+
 type ServerConfig struct {
 	ServerFs  afero.Fs
 	IgnoreCfg IgnoreConfig
 	path      string
 	fileCache map[string]string
 	server    *rpc.Server
+	// guards fileCache and IgnoreCfg, only held while the map is read or changed
+	mu sync.Mutex
+	// files are read and written under their own lock, so independent files can be
+	// written at the same time, see lockPaths
+	pathLocks pathLocks
+	// held for reading with any path lock, and for writing by whole folder operations
+	treeMu sync.RWMutex
+	// set once the client sent its ignore config
+	ignoreCfgFromClient bool
+	watcher             *fsnotify.Watcher
+	// closed once the goroutine of StartWatchFiles returned
+	watchDone chan bool
+
+	// changes made on the server, waiting for the client to poll them
+	changes      []FileChange
+	changesMu    sync.Mutex
+	changesReady chan bool
 }
 
 func NewServerConfig(fs afero.Fs) *ServerConfig {
+	ignoreCfg, err := LoadIgnoreConfig(fs)
+	if err != nil {
+		log.Println("using the default ignore config", err)
+	}
 	return &ServerConfig{
-		fileCache: make(map[string]string),
-		// TODO configurable
-		IgnoreCfg: DefaultIgnoreConfig,
-		ServerFs:  fs,
+		fileCache:    make(map[string]string),
+		IgnoreCfg:    ignoreCfg,
+		ServerFs:     fs,
+		changesReady: make(chan bool, 1),
 	}
 }
 
@@ -43,6 +86,10 @@ func (c *ServerConfig) BuildCache() {
 			log.Println("walk err", err)
 			return err
 		}
+		if info.IsDir() && c.IgnoreCfg.IgnoresDir(c.ServerFs, path) {
+			log.Println("skipping ignored dir", path)
+			return filepath.SkipDir
+		}
 
 		if !c.IgnoreCfg.ShouldIgnore(c.ServerFs, path) {
 			log.Println("caching ", path)
@@ -50,7 +97,7 @@ func (c *ServerConfig) BuildCache() {
 				// add only files to cache
 				buf, err := afero.ReadFile(c.ServerFs, path)
 				die("read file", err)
-				c.fileCache[path] = string(buf)
+				c.setCached(path, string(buf))
 			}
 		} else {
 			log.Print("ignoring ", path)
@@ -66,79 +113,636 @@ func (c *ServerConfig) ReadCommands(conn io.ReadWriteCloser) {
 	c.server.ServeConn(conn)
 }
 
-func (c *ServerConfig) Delta(deltas TextFileDeltas, _ *int) error {
-	// make sure all diffs are valid before writing them to disk and cache
-	filesToWrite := make([]TextFile, len(deltas))
+// the cached content of path, which is what the client has
+func (c *ServerConfig) cached(path string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	content, ok := c.fileCache[path]
+	return content, ok
+}
+
+func (c *ServerConfig) setCached(path, content string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.fileCache[path] = content
+}
+
+func (c *ServerConfig) uncache(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.fileCache, path)
+}
+
+// locks paths for reading and writing their files and cache entries
+// whole folders can't move while they are held, see Rename
+func (c *ServerConfig) lockPaths(paths ...string) (unlock func()) {
+	c.treeMu.RLock()
+	unlockPaths := c.pathLocks.Lock(paths...)
+	return func() {
+		unlockPaths()
+		c.treeMu.RUnlock()
+	}
+}
+
+// writes files that are already checked, all of them or none,
+// and caches them once they are all on disk
+func (c *ServerConfig) writeFiles(files []BinaryFile) error {
+	err := writeFiles(c.ServerFs, files)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		c.setCached(f.Path, string(f.Content))
+	}
+	return nil
+}
+
+// one delta of any kind, with what is needed to check it against the cache
+type pendingDelta struct {
+	path           string
+	baseChecksum   uint64
+	resultChecksum uint64
+	meta           FileMeta
+	apply          func(cached string) ([]byte, error)
+}
+
+// the delta applied to cached, but only if it was made against what the server
+// has and gives what the client has
+func checkDelta(delta pendingDelta, cached string) ([]byte, error) {
+	if crc64checksum(cached) != delta.baseChecksum {
+		return nil, errors.New("made against a different base")
+	}
+	content, err := delta.apply(cached)
+	if err != nil {
+		return nil, err
+	}
+	if crc64checksum(string(content)) != delta.resultChecksum {
+		return nil, errors.New("does not give the client's content")
+	}
+	return content, nil
+}
 
+// Delta, BinaryDelta and RsyncDelta only differ in how a delta is applied
+func (c *ServerConfig) applyDeltas(deltas []pendingDelta, rejected *[]string) error {
+	paths := make([]string, len(deltas))
 	for i, delta := range deltas {
-		path := delta.Path
-		deltaStr := delta.Delta
+		paths[i] = delta.path
+	}
+	defer c.lockPaths(paths...)()
+	// make sure all deltas are valid before writing them to disk and cache
+	filesToWrite := []BinaryFile{}
+	*rejected = []string{}
 
-		diffs, err := dmp.DiffFromDelta(c.fileCache[path], deltaStr)
+	for _, delta := range deltas {
+		cached, _ := c.cached(delta.path)
+		content, err := checkDelta(delta, cached)
 		if err != nil {
-			return err
+			log.Println("rejecting delta to", delta.path, err)
+			*rejected = append(*rejected, delta.path)
+			continue
 		}
+		filesToWrite = append(filesToWrite, BinaryFile{
+			Path:     delta.path,
+			Content:  content,
+			FileMeta: delta.meta,
+		})
+	}
+	return c.writeFiles(filesToWrite)
+}
+
+func (d TextFileDelta) pending() pendingDelta {
+	return pendingDelta{
+		path:           d.Path,
+		baseChecksum:   d.BaseChecksum,
+		resultChecksum: d.ResultChecksum,
+		meta:           d.FileMeta,
+		apply: func(cached string) ([]byte, error) {
+			diffs, err := dmp.DiffFromDelta(cached, d.Delta)
+			if err != nil {
+				return nil, err
+			}
+			return []byte(dmp.DiffText2(diffs)), nil
+		},
+	}
+}
+
+func (d BinaryFileDelta) pending() pendingDelta {
+	return pendingDelta{
+		path:           d.Path,
+		baseChecksum:   d.BaseChecksum,
+		resultChecksum: d.ResultChecksum,
+		meta:           d.FileMeta,
+		apply: func(cached string) ([]byte, error) {
+			return ApplyBinaryDelta([]byte(cached), d)
+		},
+	}
+}
+
+func (d RsyncDelta) pending() pendingDelta {
+	return pendingDelta{
+		path:           d.Path,
+		baseChecksum:   d.BaseChecksum,
+		resultChecksum: d.ResultChecksum,
+		meta:           d.FileMeta,
+		apply: func(cached string) ([]byte, error) {
+			return ApplyRsyncDelta([]byte(cached), d)
+		},
+	}
+}
+
+// applies the deltas that match the cache, and returns the paths of the others
+// so that the client can send them whole
+func (c *ServerConfig) Delta(deltas TextFileDeltas, rejected *[]string) error {
+	pending := make([]pendingDelta, len(deltas))
+	for i, delta := range deltas {
+		pending[i] = delta.pending()
+	}
+	return c.applyDeltas(pending, rejected)
+}
+
+func (c *ServerConfig) BinaryDelta(deltas BinaryFileDeltas, rejected *[]string) error {
+	pending := make([]pendingDelta, len(deltas))
+	for i, delta := range deltas {
+		pending[i] = delta.pending()
+	}
+	return c.applyDeltas(pending, rejected)
+}
+
+// block signatures of cached files, for rsync deltas
+func (c *ServerConfig) GetSignatures(paths []string, sigs *[]FileSignature) error {
+	*sigs = make([]FileSignature, len(paths))
+	for i, path := range paths {
+		cached, _ := c.cached(path)
+		content := []byte(cached)
+		(*sigs)[i] = ComputeSignature(path, content, rsyncBlockSize(len(content)))
+	}
+	return nil
+}
 
-		newText := dmp.DiffText2(diffs)
-		filesToWrite[i] = TextFile{
-			Path:    path,
-			Content: newText,
+// the file can change between GetSignatures and RsyncDelta, which the checksums catch
+func (c *ServerConfig) RsyncDelta(deltas RsyncDeltas, rejected *[]string) error {
+	pending := make([]pendingDelta, len(deltas))
+	for i, delta := range deltas {
+		pending[i] = delta.pending()
+	}
+	return c.applyDeltas(pending, rejected)
+}
+
+// removes files from disk and cache
+// files which are already gone are not an error
+func (c *ServerConfig) DeleteFiles(paths []string, _ *int) error {
+	defer c.lockPaths(paths...)()
+	for _, path := range paths {
+		log.Println("delete", path)
+		err := c.ServerFs.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
 		}
+		c.uncache(path)
 	}
-	for _, f := range filesToWrite {
-		err := afero.WriteFile(c.ServerFs, f.Path, []byte(f.Content), 0644)
+	return nil
+}
+
+// moves files or whole folders, along with their cache entries
+// nothing else runs meanwhile, since any path below a folder can change
+func (c *ServerConfig) Rename(renames FileRenames, _ *int) error {
+	c.treeMu.Lock()
+	defer c.treeMu.Unlock()
+	for _, rename := range renames {
+		log.Println("rename", rename.OldPath, "to", rename.NewPath)
+		err := c.ServerFs.MkdirAll(filepath.Dir(rename.NewPath), 0755)
+		if err != nil {
+			return err
+		}
+		err = c.ServerFs.Rename(rename.OldPath, rename.NewPath)
 		if err != nil {
 			return err
 		}
-		c.fileCache[f.Path] = f.Content
+		c.mu.Lock()
+		renameCacheEntries(c.fileCache, rename.OldPath, rename.NewPath)
+		c.mu.Unlock()
 	}
 	return nil
 }
 
-func (c *ServerConfig) GetFileHashes(_ int, index *ChecksumIndex) error {
-	m := make(ChecksumIndex)
+// applies a whole Commit, or nothing of it if anything fails
+// if a delta doesn't match the cache nothing is applied either, and the client
+// sends the commit again with the rejected paths whole
+func (c *ServerConfig) Commit(commit Commit, rejected *[]string) error {
+	// renames can move any path, so nothing else runs meanwhile
+	c.treeMu.Lock()
+	defer c.treeMu.Unlock()
+
+	pending := []pendingDelta{}
+	for _, delta := range commit.TextDeltas {
+		pending = append(pending, delta.pending())
+	}
+	for _, delta := range commit.BinaryDeltas {
+		pending = append(pending, delta.pending())
+	}
+	for _, delta := range commit.RsyncDeltas {
+		pending = append(pending, delta.pending())
+	}
+	files := append([]BinaryFile{}, commit.Files...)
+	*rejected = []string{}
+	for _, delta := range pending {
+		// deltas are made against the files at their new paths
+		cached, _ := c.cached(pathBeforeRenames(commit.Renames, delta.path))
+		content, err := checkDelta(delta, cached)
+		if err != nil {
+			log.Println("rejecting delta to", delta.path, err)
+			*rejected = append(*rejected, delta.path)
+			continue
+		}
+		files = append(files, BinaryFile{
+			Path:     delta.path,
+			Content:  content,
+			FileMeta: delta.meta,
+		})
+	}
+	if len(*rejected) > 0 {
+		return nil
+	}
+
+	// the files are written at their new paths, so the renames go first
+	renamed, err := c.renameFiles(commit.Renames)
+	if err == nil {
+		batch := &writeBatch{fs: c.ServerFs}
+		for _, f := range files {
+			err = batch.stage(f.Path, f.Content, f.FileMeta)
+			if err != nil {
+				break
+			}
+		}
+		for _, path := range commit.Deletes {
+			if err != nil {
+				break
+			}
+			log.Println("delete", path)
+			err = batch.remove(path)
+		}
+		if err == nil {
+			err = batch.commit()
+		} else {
+			batch.abort()
+		}
+	}
+	if err != nil {
+		c.undoRenames(commit.Renames[:renamed])
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, rename := range commit.Renames {
+		renameCacheEntries(c.fileCache, rename.OldPath, rename.NewPath)
+	}
+	for _, f := range files {
+		c.fileCache[f.Path] = string(f.Content)
+	}
+	for _, path := range commit.Deletes {
+		delete(c.fileCache, path)
+	}
+	return nil
+}
+
+// renames on disk only, returns how many are done
+func (c *ServerConfig) renameFiles(renames FileRenames) (int, error) {
+	for i, rename := range renames {
+		log.Println("rename", rename.OldPath, "to", rename.NewPath)
+		err := c.ServerFs.MkdirAll(filepath.Dir(rename.NewPath), 0755)
+		if err == nil {
+			err = c.ServerFs.Rename(rename.OldPath, rename.NewPath)
+		}
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(renames), nil
+}
+
+func (c *ServerConfig) undoRenames(renames FileRenames) {
+	for i := len(renames) - 1; i >= 0; i-- {
+		err := c.ServerFs.Rename(renames[i].NewPath, renames[i].OldPath)
+		if err != nil {
+			log.Println("could not undo rename of", renames[i].OldPath, err)
+		}
+	}
+}
+
+// where path was before renames, which happened in order
+func pathBeforeRenames(renames FileRenames, path string) string {
+	for i := len(renames) - 1; i >= 0; i-- {
+		if oldPath, ok := renamedPath(path, renames[i].NewPath, renames[i].OldPath); ok {
+			path = oldPath
+		}
+	}
+	return path
+}
+
+// a copy of the cache, to work on without holding the lock
+func (c *ServerConfig) cacheSnapshot() map[string]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	snapshot := make(map[string]string, len(c.fileCache))
 	for path, text := range c.fileCache {
+		snapshot[path] = text
+	}
+	return snapshot
+}
+
+func (c *ServerConfig) GetFileHashes(req FileIndexRequest, index *FileIndex) error {
+	snapshot := c.cacheSnapshot()
+	paths := req.Paths
+	if paths == nil {
+		paths = make([]string, 0, len(snapshot))
+		for path := range snapshot {
+			paths = append(paths, path)
+		}
+	}
+	m := make(FileIndex)
+	for _, path := range paths {
+		text, ok := snapshot[path]
+		if !ok {
+			continue
+		}
 		log.Println(path)
-		m[path] = crc64checksum(text)
+		entry := FileIndexEntry{
+			Size:    int64(len(text)),
+			ModTime: statFileMeta(c.ServerFs, path).ModTime,
+		}
+		if req.Hash != "" {
+			var err error
+			entry.Hash, err = hashContent(req.Hash, text)
+			if err != nil {
+				return err
+			}
+		}
+		m[path] = entry
 	}
 	*index = m
 	return nil
 }
 
+func (c *ServerConfig) GetFileModes(_ int, modes *FileModeIndex) error {
+	m := make(FileModeIndex)
+	for path := range c.cacheSnapshot() {
+		m[path] = statFileMeta(c.ServerFs, path).Mode
+	}
+	*modes = m
+	return nil
+}
+
+// changes permission bits without touching content
+func (c *ServerConfig) Chmod(modes FileModeIndex, _ *int) error {
+	paths := make([]string, 0, len(modes))
+	for path := range modes {
+		paths = append(paths, path)
+	}
+	defer c.lockPaths(paths...)()
+	for path, mode := range modes {
+		log.Println("chmod", path, mode)
+		err := c.ServerFs.Chmod(path, mode.Perm())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (c *ServerConfig) GetTextFile(path string, content *string) error {
-	*content = c.fileCache[path]
+	*content, _ = c.cached(path)
 	return nil
 }
 
 func (c *ServerConfig) GetTextFiles(paths []string, files *[]TextFile) error {
+	defer c.lockPaths(paths...)()
 	*files = make([]TextFile, len(paths))
 	for i, path := range paths {
 		(*files)[i].Path = path
-		(*files)[i].Content = c.fileCache[path]
+		(*files)[i].Content, _ = c.cached(path)
+		(*files)[i].FileMeta = statFileMeta(c.ServerFs, path)
 	}
 	return nil
 }
 
 // warning: blindly overwrites existing files
 func (c *ServerConfig) SendTextFile(file TextFile, _ *int) error {
+	defer c.lockPaths(file.Path)()
 	//	TODO cache entire file, not just Content (because maybe additional metadata)
-	c.fileCache[file.Path] = file.Content
-	// TODO store file mode in TextFile struct
-	return afero.WriteFile(c.ServerFs, file.Path, []byte(file.Content), 0644)
+	err := writeFile(c.ServerFs, file.Path, []byte(file.Content), file.FileMeta)
+	if err != nil {
+		return err
+	}
+	c.setCached(file.Path, file.Content)
+	return nil
 }
 
 // warning: blindly overwrites existing files
 func (c *ServerConfig) SendTextFiles(files []TextFile, _ *int) error {
-	var err error
-	for _, file := range files {
-		err = c.SendTextFile(file, nil)
+	paths := make([]string, len(files))
+	for i, file := range files {
+		paths[i] = file.Path
+	}
+	defer c.lockPaths(paths...)()
+	binaryFiles := make([]BinaryFile, len(files))
+	for i, file := range files {
+		binaryFiles[i] = BinaryFile{
+			Path:     file.Path,
+			Content:  []byte(file.Content),
+			FileMeta: file.FileMeta,
+		}
+	}
+	return c.writeFiles(binaryFiles)
+}
+
+// warning: blindly overwrites existing files
+func (c *ServerConfig) SendBinaryFiles(files []BinaryFile, _ *int) error {
+	paths := make([]string, len(files))
+	for i, file := range files {
+		paths[i] = file.Path
+	}
+	defer c.lockPaths(paths...)()
+	return c.writeFiles(files)
+}
+
+// blocks until there are changes made on the server, or until pollTimeout
+func (c *ServerConfig) PollChanges(_ int, changes *[]FileChange) error {
+	select {
+	case <-c.changesReady:
+	case <-time.After(pollTimeout):
+	}
+	c.changesMu.Lock()
+	defer c.changesMu.Unlock()
+	*changes = c.changes
+	c.changes = nil
+	return nil
+}
+
+func (c *ServerConfig) pushChanges(changes []FileChange) {
+	c.changesMu.Lock()
+	c.changes = append(c.changes, changes...)
+	c.changesMu.Unlock()
+	// wake up PollChanges without blocking if it is already awake
+	select {
+	case c.changesReady <- true:
+	default:
+	}
+}
+
+// checks paths that changed on disk against the cache
+// anything that differs was not written by the client, so it has to go back to it
+func (c *ServerConfig) checkForChanges(paths map[string]bool) []FileChange {
+	sorted := make([]string, 0, len(paths))
+	for path := range paths {
+		sorted = append(sorted, path)
+	}
+	// the client's writes to these paths have to finish first, or they look like server edits
+	defer c.lockPaths(sorted...)()
+	ignoreCfg := c.ignoreConfig()
+
+	changes := []FileChange{}
+	for path := range paths {
+		cached, inCache := c.cached(path)
+		buf, err := afero.ReadFile(c.ServerFs, path)
 		if err != nil {
-			return err
+			if os.IsNotExist(err) && inCache {
+				log.Println("deleted on server", path)
+				c.uncache(path)
+				changes = append(changes, FileChange{TextFile: TextFile{Path: path}, Deleted: true})
+			}
+			continue
 		}
+		if ignoreCfg.ShouldIgnore(c.ServerFs, path) || (inCache && string(buf) == cached) {
+			continue
+		}
+		log.Println("changed on server", path)
+		c.setCached(path, string(buf))
+		changes = append(changes, FileChange{TextFile: TextFile{
+			Path:     path,
+			Content:  string(buf),
+			FileMeta: statFileMeta(c.ServerFs, path),
+		}})
+	}
+	return changes
+}
+
+// watches absPath (the same folder as ServerFs) for edits made by something other
+// than the client, like code generators or formatters
+func (c *ServerConfig) StartWatchFiles(absPath string) error {
+	c.path = absPath
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	err = c.addWatchTree(watcher, ".")
+	if err != nil {
+		watcher.Close()
+		return err
 	}
+	done := make(chan bool)
+	c.mu.Lock()
+	c.watcher = watcher
+	c.watchDone = done
+	c.mu.Unlock()
+
+	go func() {
+		defer close(done)
+		waitingForCommit := false
+		shouldCommit := make(chan bool, 1)
+		changedPaths := make(map[string]bool)
+
+		for {
+			select {
+			case <-shouldCommit:
+				waitingForCommit = false
+				changes := c.checkForChanges(changedPaths)
+				changedPaths = make(map[string]bool)
+				if len(changes) > 0 {
+					c.pushChanges(changes)
+				}
+
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				path, err := filepath.Rel(c.path, event.Name)
+				if err == nil && isAtomicTempFile(path) {
+					continue
+				}
+				if err == nil && IsIgnoreConfigFile(path) {
+					for _, newPath := range c.reloadIgnoreConfig(watcher) {
+						changedPaths[newPath] = true
+					}
+				} else {
+					// checked without logging, because the log is written in this folder too
+					ignoreCfg := c.ignoreConfig()
+					if err != nil || ignoreCfg.matchesGlob(path) {
+						continue
+					}
+					if info, err := c.ServerFs.Stat(path); err == nil && info.IsDir() {
+						if event.Op&fsnotify.Create != 0 {
+							err = c.addWatchTree(watcher, path)
+							if err != nil {
+								log.Println("failed to watch new folder", err)
+							}
+						}
+						continue
+					}
+					changedPaths[path] = true
+				}
+				// wait for writes to settle
+				if !waitingForCommit {
+					waitingForCommit = true
+					go func() {
+						time.Sleep(commitTimeout)
+						shouldCommit <- true
+					}()
+				}
+
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Println("server watcher error", err)
+			}
+		}
+	}()
 	return nil
 }
 
+// stops watching for changes made on the server, the watcher goroutine
+// has returned once Close does
+func (c *ServerConfig) Close() error {
+	c.mu.Lock()
+	watcher, done := c.watcher, c.watchDone
+	c.watcher = nil
+	c.mu.Unlock()
+	if watcher == nil {
+		return nil
+	}
+	err := watcher.Close()
+	<-done
+	return err
+}
+
+// watches every folder below root, files are seen through their folders
+func (c *ServerConfig) addWatchTree(watcher *fsnotify.Watcher, root string) error {
+	ignoreCfg := c.ignoreConfig()
+	return afero.Walk(c.ServerFs, root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if ignoreCfg.IgnoresDir(c.ServerFs, path) {
+				return filepath.SkipDir
+			}
+			return watcher.Add(filepath.Join(c.path, path))
+		}
+		return nil
+	})
+}
+
 func ServerMain() {
 	//sourceDir := os.Getenv(EnvSourceDir)
 	reader := bufio.NewReader(os.Stdin)
@@ -157,9 +761,20 @@ func ServerMain() {
 	wd, err := os.Getwd()
 	die("get cwd", err)
 
-	server.IgnoreCfg = DefaultIgnoreConfig
 	server.path = wd
-	server.BuildCache()
 
-	server.ReadCommands(&ReadWriteCloseAdapter{os.Stdout, os.Stdin})
+	// before anything slow, the client only waits compressionTimeout for the answer
+	// reader may have read past the source dir already, so the rest comes from it too
+	conn, compression, err := AcceptCompression(reader, &ReadWriteCloseAdapter{os.Stdin, os.Stdout})
+	die("negotiate compression", err)
+	log.Println("compression", compression)
+
+	// no BuildCache, the client sends its ignore config right after Hello,
+	// and SetIgnoreConfig builds the cache with it
+	err = server.StartWatchFiles(wd)
+	if err != nil {
+		log.Println("not watching for changes on the server", err)
+	}
+	defer server.Close()
+	server.ReadCommands(conn)
 }
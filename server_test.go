@@ -1,12 +1,17 @@
 package sshsync_test
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"github.com/stretchr/testify/assert"
-	"github.com/sergi/go-diff/diffmatchpatch"
 	"github.com/spf13/afero"
 	"testing"
 	"net/rpc"
 	"github.com/Joshua-Wright/sshsync"
+	"os"
+	"time"
+	"path/filepath"
 )
 
 func TestServerGetTextFile(t *testing.T) {
@@ -49,11 +54,33 @@ func TestServerGetHashes(t *testing.T) {
 	go server.ReadCommands(serverConn)
 	client := rpc.NewClient(clientConn)
 
-	var out sshsync.ChecksumIndex
-	err := client.Call(sshsync.Server_GetFileHashes, 0, &out)
+	var out sshsync.FileIndex
+	err := client.Call(sshsync.Server_GetFileHashes, sshsync.FileIndexRequest{}, &out)
 	assert.NoError(t, err)
-	_, ok := out["testFile.txt"]
+	entry, ok := out["testFile.txt"]
 	assert.True(t, ok)
+	assert.Equal(t, int64(len(string1)), entry.Size)
+	assert.False(t, entry.ModTime.IsZero())
+	// hashes only when asked for
+	assert.Empty(t, entry.Hash)
+
+	hashes := map[string]string{}
+	for _, hash := range sshsync.Hashes {
+		err = client.Call(sshsync.Server_GetFileHashes, sshsync.FileIndexRequest{
+			Hash:  hash,
+			Paths: []string{"testFile.txt", "missing.txt"},
+		}, &out)
+		assert.NoError(t, err)
+		assert.Len(t, out, 1)
+		assert.NotEmpty(t, out["testFile.txt"].Hash)
+		hashes[hash] = out["testFile.txt"].Hash
+	}
+	assert.Equal(t, sha256Hex(string1), hashes[sshsync.HashSha256])
+	assert.Len(t, hashes[sshsync.HashXxh3], 32)
+	assert.Len(t, hashes[sshsync.HashBlake3], 64)
+
+	err = client.Call(sshsync.Server_GetFileHashes, sshsync.FileIndexRequest{Hash: "md5"}, &out)
+	assert.Error(t, err)
 
 	client.Close()
 	clientConn.Close()
@@ -113,9 +140,7 @@ func TestServerDelta(t *testing.T) {
 	// write test data to file
 	afero.WriteFile(serverFs, "testFile.txt", []byte(string1), 0644)
 	// get Delta
-	dmp := diffmatchpatch.New()
-	diffs := dmp.DiffMain(string1, string2, false)
-	delta := dmp.DiffToDelta(diffs)
+	delta := sshsync.MakeTextDelta("testFile.txt", string1, string2)
 
 	// create server
 	server := sshsync.NewServerConfig(serverFs)
@@ -125,17 +150,487 @@ func TestServerDelta(t *testing.T) {
 
 	// test call
 	client := rpc.NewClient(clientConn)
-	err := client.Call(sshsync.Server_Delta, sshsync.TextFileDeltas{
-		{
-			Path:  "testFile.txt",
-			Delta: delta,
-		}}, nil)
+	var rejected []string
+	err := client.Call(sshsync.Server_Delta, sshsync.TextFileDeltas{delta}, &rejected)
 	assert.NoError(t, err)
+	assert.Empty(t, rejected)
 
 	// verify file now contains string2
 	AssertFileContent(t, serverFs, "testFile.txt", string2)
 
+	// a delta made against something else than the server has is not applied
+	wrongBase := sshsync.MakeTextDelta("testFile.txt", string1, "something else")
+	// the same length, so the delta itself still fits
+	sameLength := sshsync.MakeTextDelta("testFile.txt", "tested string 333\nline 3", "x")
+	err = client.Call(sshsync.Server_Delta, sshsync.TextFileDeltas{wrongBase, sameLength}, &rejected)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"testFile.txt", "testFile.txt"}, rejected)
+	AssertFileContent(t, serverFs, "testFile.txt", string2)
+
+	// and neither is one that doesn't give the text the client has
+	wrongResult := sshsync.MakeTextDelta("testFile.txt", string2, "new text")
+	wrongResult.ResultChecksum++
+	err = client.Call(sshsync.Server_Delta, sshsync.TextFileDeltas{wrongResult}, &rejected)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"testFile.txt"}, rejected)
+	AssertFileContent(t, serverFs, "testFile.txt", string2)
+
+	client.Close()
+	clientConn.Close()
+	serverConn.Close()
+}
+
+func TestServerDeleteFiles(t *testing.T) {
+	var serverFs = afero.NewMemMapFs()
+	afero.WriteFile(serverFs, "deleted.txt", []byte("delete me"), 0644)
+	afero.WriteFile(serverFs, "kept.txt", []byte("keep me"), 0644)
+
+	server := sshsync.NewServerConfig(serverFs)
+	server.BuildCache()
+	clientConn, serverConn := sshsync.TwoWayPipe()
+	go server.ReadCommands(serverConn)
+	client := rpc.NewClient(clientConn)
+
+	// files that are already gone are not an error
+	err := client.Call(sshsync.Server_DeleteFiles, []string{"deleted.txt", "never existed.txt"}, nil)
+	assert.NoError(t, err)
+
+	_, err = serverFs.Stat("deleted.txt")
+	assert.True(t, os.IsNotExist(err))
+	AssertFileContent(t, serverFs, "kept.txt", "keep me")
+
+	// deleted file is no longer in the index
+	var out sshsync.FileIndex
+	err = client.Call(sshsync.Server_GetFileHashes, sshsync.FileIndexRequest{}, &out)
+	assert.NoError(t, err)
+	_, ok := out["deleted.txt"]
+	assert.False(t, ok)
+	_, ok = out["kept.txt"]
+	assert.True(t, ok)
+
+	client.Close()
+	clientConn.Close()
+	serverConn.Close()
+}
+
+func TestServerRename(t *testing.T) {
+	var serverFs = afero.NewMemMapFs()
+	afero.WriteFile(serverFs, "old.txt", []byte("moved file"), 0644)
+	afero.WriteFile(serverFs, "olddir/a.txt", []byte("a"), 0644)
+	afero.WriteFile(serverFs, "olddir/sub/b.txt", []byte("b"), 0644)
+
+	server := sshsync.NewServerConfig(serverFs)
+	server.BuildCache()
+	clientConn, serverConn := sshsync.TwoWayPipe()
+	go server.ReadCommands(serverConn)
+	client := rpc.NewClient(clientConn)
+
+	err := client.Call(sshsync.Server_Rename, sshsync.FileRenames{
+		{OldPath: "old.txt", NewPath: "new/new.txt"},
+		{OldPath: "olddir", NewPath: "newdir"},
+	}, nil)
+	assert.NoError(t, err)
+
+	AssertFileContent(t, serverFs, "new/new.txt", "moved file")
+	AssertFileContent(t, serverFs, "newdir/a.txt", "a")
+	AssertFileContent(t, serverFs, "newdir/sub/b.txt", "b")
+	_, err = serverFs.Stat("old.txt")
+	assert.True(t, os.IsNotExist(err))
+
+	// cache entries move along with the files
+	var out string
+	err = client.Call(sshsync.Server_GetTextFile, "newdir/sub/b.txt", &out)
+	assert.NoError(t, err)
+	assert.Equal(t, "b", out)
+	var index sshsync.FileIndex
+	err = client.Call(sshsync.Server_GetFileHashes, sshsync.FileIndexRequest{}, &index)
+	assert.NoError(t, err)
+	assert.Len(t, index, 3)
+	_, ok := index["olddir/a.txt"]
+	assert.False(t, ok)
+
+	client.Close()
+	clientConn.Close()
+	serverConn.Close()
+}
+
+func TestServerBinaryFiles(t *testing.T) {
+	var serverFs = afero.NewMemMapFs()
+	original := []byte{0x89, 'P', 'N', 'G', 0, 0xff, 0xfe, 1, 2, 3}
+	changed := []byte{0x89, 'P', 'N', 'G', 0, 0x00, 0x80, 1, 2, 3}
+
+	server := sshsync.NewServerConfig(serverFs)
+	server.BuildCache()
+	clientConn, serverConn := sshsync.TwoWayPipe()
+	go server.ReadCommands(serverConn)
+	client := rpc.NewClient(clientConn)
+
+	err := client.Call(sshsync.Server_SendBinaryFiles, []sshsync.BinaryFile{
+		{Path: "image.png", Content: original},
+	}, nil)
+	assert.NoError(t, err)
+	AssertFileContent(t, serverFs, "image.png", string(original))
+
+	err = client.Call(sshsync.Server_BinaryDelta, sshsync.BinaryFileDeltas{
+		sshsync.MakeBinaryDelta("image.png", original, changed),
+	}, nil)
+	assert.NoError(t, err)
+	AssertFileContent(t, serverFs, "image.png", string(changed))
+
+	// delta made against another base is rejected without writing anything
+	rejected := []string{}
+	err = client.Call(sshsync.Server_BinaryDelta, sshsync.BinaryFileDeltas{
+		sshsync.MakeBinaryDelta("image.png", original, []byte("other")),
+	}, &rejected)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"image.png"}, rejected)
+	AssertFileContent(t, serverFs, "image.png", string(changed))
+
+	// so is one that doesn't fit the cached content
+	delta := sshsync.MakeBinaryDelta("image.png", changed, changed)
+	delta.Prefix = 100
+	err = client.Call(sshsync.Server_BinaryDelta, sshsync.BinaryFileDeltas{delta}, &rejected)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"image.png"}, rejected)
+	AssertFileContent(t, serverFs, "image.png", string(changed))
+
+	client.Close()
+	clientConn.Close()
+	serverConn.Close()
+}
+
+func TestServerRsyncDelta(t *testing.T) {
+	var serverFs = afero.NewMemMapFs()
+	original := bytes.Repeat([]byte("0123456789abcdef"), 10000)
+	changed := append(append([]byte{}, original[:5000]...), append([]byte("changed"), original[5000:]...)...)
+	afero.WriteFile(serverFs, "big.txt", original, 0644)
+
+	server := sshsync.NewServerConfig(serverFs)
+	server.BuildCache()
+	clientConn, serverConn := sshsync.TwoWayPipe()
+	go server.ReadCommands(serverConn)
+	client := rpc.NewClient(clientConn)
+
+	sigs := []sshsync.FileSignature{}
+	err := client.Call(sshsync.Server_GetSignatures, []string{"big.txt"}, &sigs)
+	assert.NoError(t, err)
+	assert.Len(t, sigs, 1)
+
+	err = client.Call(sshsync.Server_RsyncDelta, sshsync.RsyncDeltas{
+		sshsync.ComputeRsyncDelta(sigs[0], changed),
+	}, nil)
+	assert.NoError(t, err)
+	AssertFileContent(t, serverFs, "big.txt", string(changed))
+
+	// the file changed since the signatures were made, so the delta is rejected
+	rejected := []string{}
+	err = client.Call(sshsync.Server_RsyncDelta, sshsync.RsyncDeltas{
+		sshsync.ComputeRsyncDelta(sigs[0], original),
+	}, &rejected)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"big.txt"}, rejected)
+	AssertFileContent(t, serverFs, "big.txt", string(changed))
+
+	client.Close()
+	clientConn.Close()
+	serverConn.Close()
+}
+
+func TestServerFileModes(t *testing.T) {
+	var serverFs = afero.NewMemMapFs()
+	afero.WriteFile(serverFs, "script.sh", []byte("echo hi"), 0644)
+	afero.WriteFile(serverFs, "readme.txt", []byte("hi"), 0644)
+
+	server := sshsync.NewServerConfig(serverFs)
+	server.BuildCache()
+	clientConn, serverConn := sshsync.TwoWayPipe()
+	go server.ReadCommands(serverConn)
+	client := rpc.NewClient(clientConn)
+
+	// new files get the mode that was sent
+	err := client.Call(sshsync.Server_SendTextFile, sshsync.TextFile{
+		Path:     "new.sh",
+		Content:  "echo new",
+		FileMeta: sshsync.FileMeta{Mode: 0755},
+	}, nil)
+	assert.NoError(t, err)
+	AssertFileMode(t, serverFs, "new.sh", 0755)
+
+	// deltas change the mode of existing files
+	delta := sshsync.MakeTextDelta("script.sh", "echo hi", "echo hi")
+	delta.FileMeta = sshsync.FileMeta{Mode: 0700}
+	err = client.Call(sshsync.Server_Delta, sshsync.TextFileDeltas{delta}, nil)
+	assert.NoError(t, err)
+	AssertFileMode(t, serverFs, "script.sh", 0700)
+
+	// no mode leaves the existing one alone
+	delta.FileMeta = sshsync.FileMeta{}
+	err = client.Call(sshsync.Server_Delta, sshsync.TextFileDeltas{delta}, nil)
+	assert.NoError(t, err)
+	AssertFileMode(t, serverFs, "script.sh", 0700)
+
+	var modes sshsync.FileModeIndex
+	err = client.Call(sshsync.Server_GetFileModes, 0, &modes)
+	assert.NoError(t, err)
+	assert.Equal(t, sshsync.FileModeIndex{
+		"script.sh":  0700,
+		"readme.txt": 0644,
+		"new.sh":     0755,
+	}, modes)
+
+	err = client.Call(sshsync.Server_Chmod, sshsync.FileModeIndex{"readme.txt": 0600}, nil)
+	assert.NoError(t, err)
+	AssertFileMode(t, serverFs, "readme.txt", 0600)
+
+	var files []sshsync.TextFile
+	err = client.Call(sshsync.Server_GetTextFiles, []string{"new.sh"}, &files)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), files[0].Mode)
+
 	client.Close()
 	clientConn.Close()
 	serverConn.Close()
 }
+
+func TestServerModTime(t *testing.T) {
+	var serverFs = afero.NewMemMapFs()
+	afero.WriteFile(serverFs, "file.txt", []byte("content"), 0644)
+	modTime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+
+	server := sshsync.NewServerConfig(serverFs)
+	server.BuildCache()
+	clientConn, serverConn := sshsync.TwoWayPipe()
+	go server.ReadCommands(serverConn)
+	client := rpc.NewClient(clientConn)
+
+	assertModTime := func(path string, expected time.Time) {
+		info, err := serverFs.Stat(path)
+		assert.NoError(t, err)
+		assert.True(t, expected.Equal(info.ModTime()), "%s has %s", path, info.ModTime())
+	}
+
+	err := client.Call(sshsync.Server_SendTextFile, sshsync.TextFile{
+		Path:     "new.txt",
+		Content:  "new",
+		FileMeta: sshsync.FileMeta{ModTime: modTime},
+	}, nil)
+	assert.NoError(t, err)
+	assertModTime("new.txt", modTime)
+
+	delta := sshsync.MakeTextDelta("file.txt", "content", "content!")
+	delta.FileMeta = sshsync.FileMeta{ModTime: modTime}
+	err = client.Call(sshsync.Server_Delta, sshsync.TextFileDeltas{delta}, nil)
+	assert.NoError(t, err)
+	assertModTime("file.txt", modTime)
+
+	// no modification time means the file is touched
+	before := time.Now().Add(-time.Second)
+	err = client.Call(sshsync.Server_Delta, sshsync.TextFileDeltas{
+		sshsync.MakeTextDelta("file.txt", "content!", "content!"),
+	}, nil)
+	assert.NoError(t, err)
+	info, err := serverFs.Stat("file.txt")
+	assert.NoError(t, err)
+	assert.True(t, info.ModTime().After(before))
+
+	client.Close()
+	clientConn.Close()
+	serverConn.Close()
+}
+
+func TestServerWatchChanges(t *testing.T) {
+	WithFolder(t, "TestServerWatchChanges", func(serverPath string, serverFs afero.Fs) {
+		assert.NoError(t, afero.WriteFile(serverFs, "deleted.txt", []byte("deleted"), 0644))
+		assert.NoError(t, afero.WriteFile(serverFs, "client.txt", []byte("client"), 0644))
+
+		server := sshsync.NewServerConfig(serverFs)
+		server.BuildCache()
+		assert.NoError(t, server.StartWatchFiles(serverPath))
+		defer server.Close()
+		clientConn, serverConn := sshsync.TwoWayPipe()
+		go server.ReadCommands(serverConn)
+		client := rpc.NewClient(clientConn)
+
+		// writes from the client are not sent back
+		err := client.Call(sshsync.Server_SendTextFile, sshsync.TextFile{Path: "client.txt", Content: "from client"}, nil)
+		assert.NoError(t, err)
+		// but edits made on the server are
+		assert.NoError(t, os.WriteFile(filepath.Join(serverPath, "generated.txt"), []byte("generated"), 0644))
+		assert.NoError(t, os.Remove(filepath.Join(serverPath, "deleted.txt")))
+
+		changes := []sshsync.FileChange{}
+		deadline := time.Now().Add(5 * time.Second)
+		for len(changes) < 2 && time.Now().Before(deadline) {
+			var polled []sshsync.FileChange
+			err = client.Call(sshsync.Server_PollChanges, 0, &polled)
+			assert.NoError(t, err)
+			changes = append(changes, polled...)
+		}
+
+		byPath := make(map[string]sshsync.FileChange)
+		for _, change := range changes {
+			byPath[change.Path] = change
+		}
+		assert.Len(t, byPath, 2)
+		assert.Equal(t, "generated", byPath["generated.txt"].Content)
+		assert.False(t, byPath["generated.txt"].Deleted)
+		assert.True(t, byPath["deleted.txt"].Deleted)
+
+		// the cache follows the server's edits, so the next delta applies to them
+		var content string
+		err = client.Call(sshsync.Server_GetTextFile, "generated.txt", &content)
+		assert.NoError(t, err)
+		assert.Equal(t, "generated", content)
+
+		client.Close()
+		clientConn.Close()
+		serverConn.Close()
+	})
+}
+
+// many clients' worth of calls at once, run with -race
+func TestServerCloseStopsWatching(t *testing.T) {
+	WithFolder(t, "TestServerCloseStopsWatching", func(serverPath string, serverFs afero.Fs) {
+		server := sshsync.NewServerConfig(serverFs)
+		server.BuildCache()
+		assert.NoError(t, server.StartWatchFiles(serverPath))
+
+		// Close waits for the watcher goroutine, so it would hang if that kept running
+		closed := make(chan error)
+		go func() { closed <- server.Close() }()
+		select {
+		case err := <-closed:
+			assert.NoError(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("watcher goroutine still running")
+		}
+		// nothing left to close
+		assert.NoError(t, server.Close())
+	})
+}
+
+func TestServerConcurrentRequests(t *testing.T) {
+	WithFolder(t, "TestServerConcurrentRequests", func(serverPath string, serverFs afero.Fs) {
+		assert.NoError(t, serverFs.Mkdir("moving", 0755))
+		const workers = 8
+		const rounds = 30
+		for w := 0; w < workers; w++ {
+			assert.NoError(t, serverFs.Mkdir("worker"+string(rune('a'+w)), 0755))
+		}
+		assert.NoError(t, afero.WriteFile(serverFs, "moving/a.txt", []byte("moving"), 0644))
+		server := sshsync.NewServerConfig(serverFs)
+		server.BuildCache()
+		// the watcher checks the same files in the background
+		assert.NoError(t, server.StartWatchFiles(serverPath))
+		defer server.Close()
+		clientConn, serverConn := sshsync.TwoWayPipe()
+		go server.ReadCommands(serverConn)
+		client := rpc.NewClient(clientConn)
+
+		done := make(chan bool)
+		for w := 0; w < workers; w++ {
+			go func(w int) {
+				defer func() { done <- true }()
+				path := filepath.Join("worker"+string(rune('a'+w)), "file.txt")
+				for i := 0; i < rounds; i++ {
+					content := path + " round " + string(rune('a'+i))
+					edited := content + " edited"
+					err := client.Call(sshsync.Server_SendTextFile, sshsync.TextFile{Path: path, Content: content}, nil)
+					assert.NoError(t, err)
+					delta := sshsync.MakeTextDelta(path, content, edited)
+					err = client.Call(sshsync.Server_Delta, sshsync.TextFileDeltas{delta}, nil)
+					assert.NoError(t, err)
+
+					var files []sshsync.TextFile
+					err = client.Call(sshsync.Server_GetTextFiles, []string{path}, &files)
+					assert.NoError(t, err)
+					if assert.Len(t, files, 1) {
+						assert.Equal(t, edited, files[0].Content)
+					}
+					var index sshsync.FileIndex
+					assert.NoError(t, client.Call(sshsync.Server_GetFileHashes, sshsync.FileIndexRequest{}, &index))
+				}
+			}(w)
+		}
+		// moves a whole folder back and forth meanwhile
+		go func() {
+			defer func() { done <- true }()
+			from, to := "moving", "moved"
+			for i := 0; i < rounds; i++ {
+				err := client.Call(sshsync.Server_Rename, sshsync.FileRenames{{OldPath: from, NewPath: to}}, nil)
+				assert.NoError(t, err)
+				from, to = to, from
+			}
+		}()
+		for w := 0; w < workers+1; w++ {
+			<-done
+		}
+
+		var index sshsync.FileIndex
+		assert.NoError(t, client.Call(sshsync.Server_GetFileHashes, sshsync.FileIndexRequest{}, &index))
+		for w := 0; w < workers; w++ {
+			path := filepath.Join("worker"+string(rune('a'+w)), "file.txt")
+			expected := path + " round " + string(rune('a'+rounds-1)) + " edited"
+			AssertFileContent(t, serverFs, path, expected)
+			assert.Contains(t, index, path)
+		}
+		// renamed an even number of times
+		AssertFileContent(t, serverFs, "moving/a.txt", "moving")
+		assert.Contains(t, index, "moving/a.txt")
+
+		client.Close()
+		clientConn.Close()
+		serverConn.Close()
+	})
+}
+
+// deltas to the same file from several goroutines must apply one after the other
+func TestServerConcurrentDeltasSameFile(t *testing.T) {
+	WithFolder(t, "TestServerConcurrentDeltasSameFile", func(serverPath string, serverFs afero.Fs) {
+		assert.NoError(t, afero.WriteFile(serverFs, "shared.txt", []byte(""), 0644))
+		server := sshsync.NewServerConfig(serverFs)
+		server.BuildCache()
+		clientConn, serverConn := sshsync.TwoWayPipe()
+		go server.ReadCommands(serverConn)
+		client := rpc.NewClient(clientConn)
+
+		// each call appends a line, which is rejected if another append slipped in
+		// between reading the cache and writing the file
+		const calls = 100
+		done := make(chan bool)
+		for i := 0; i < calls; i++ {
+			go func() {
+				defer func() { done <- true }()
+				var content string
+				for {
+					assert.NoError(t, client.Call(sshsync.Server_GetTextFile, "shared.txt", &content))
+					delta := sshsync.MakeTextDelta("shared.txt", content, content+"x\n")
+					var rejected []string
+					err := client.Call(sshsync.Server_Delta, sshsync.TextFileDeltas{delta}, &rejected)
+					assert.NoError(t, err)
+					if len(rejected) == 0 {
+						return
+					}
+				}
+			}()
+		}
+		for i := 0; i < calls; i++ {
+			<-done
+		}
+		buf, err := afero.ReadFile(serverFs, "shared.txt")
+		assert.NoError(t, err)
+		assert.Equal(t, calls, bytes.Count(buf, []byte("x\n")))
+		var content string
+		assert.NoError(t, client.Call(sshsync.Server_GetTextFile, "shared.txt", &content))
+		assert.Equal(t, string(buf), content)
+
+		client.Close()
+		clientConn.Close()
+		serverConn.Close()
+	})
+}
+
+func sha256Hex(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
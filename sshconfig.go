@@ -0,0 +1,155 @@
+package sshsync
+
+import (
+	"github.com/kevinburke/ssh_config"
+	"github.com/pkg/errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// where to connect to for a host name or alias, as ssh_config has it
+// User is empty if the config doesn't set one
+type SshHost struct {
+	Alias    string
+	HostName string
+	User     string
+	Port     string
+	// as written in the config, see KeyFiles
+	IdentityFiles []string
+	// comma separated hosts to connect through, like ssh -J
+	ProxyJump string
+}
+
+func (h SshHost) Address() string {
+	return net.JoinHostPort(h.HostName, h.Port)
+}
+
+// ~/.ssh/config and /etc/ssh/ssh_config, or a single file given on the command line
+type SshConfig struct {
+	settings *ssh_config.UserSettings
+}
+
+func DefaultSshConfig() *SshConfig {
+	return &SshConfig{&ssh_config.UserSettings{}}
+}
+
+func LoadSshConfig(file string) *SshConfig {
+	settings := &ssh_config.UserSettings{}
+	settings.ConfigFinder(func() string { return file })
+	return &SshConfig{settings}
+}
+
+// looks up alias, following Include directives
+func (c *SshConfig) Resolve(alias string) (SshHost, error) {
+	host := SshHost{Alias: alias}
+	var err error
+	get := func(key string) string {
+		if err != nil {
+			return ""
+		}
+		var value string
+		value, err = c.settings.GetStrict(alias, key)
+		return value
+	}
+
+	host.HostName = strings.Replace(get("HostName"), "%h", alias, -1)
+	if host.HostName == "" {
+		host.HostName = alias
+	}
+	host.User = get("User")
+	host.Port = get("Port")
+	if proxyJump := get("ProxyJump"); proxyJump != "none" {
+		host.ProxyJump = proxyJump
+	}
+	if err != nil {
+		return host, err
+	}
+
+	identityFiles, err := c.settings.GetAllStrict(alias, "IdentityFile")
+	if err != nil {
+		return host, err
+	}
+	// the library fills in the default when nothing is set, which is not what ssh uses
+	if len(identityFiles) == 1 && identityFiles[0] == ssh_config.Default("IdentityFile") {
+		identityFiles = nil
+	}
+	host.IdentityFiles = identityFiles
+	return host, nil
+}
+
+// IdentityFiles with ~ and the common % tokens expanded,
+// after the user and port were overridden from the command line
+func (h SshHost) KeyFiles() []string {
+	home := os.Getenv("HOME")
+	tokens := strings.NewReplacer(
+		"%d", home,
+		"%h", h.HostName,
+		"%n", h.Alias,
+		"%p", h.Port,
+		"%r", h.User,
+		"%%", "%",
+	)
+	keyFiles := []string{}
+	for _, path := range h.IdentityFiles {
+		if strings.HasPrefix(path, "~/") {
+			path = filepath.Join(home, path[2:])
+		}
+		keyFiles = append(keyFiles, tokens.Replace(path))
+	}
+	return keyFiles
+}
+
+// how many jump hosts that have their own ProxyJump are followed, against loops
+const maxProxyJumpDepth = 8
+
+// jump hosts from a ProxyJump value, [user@]host[:port] separated by commas
+// each one is looked up in the config too, what is in the value overrides it
+// like ssh, the first one is reached through its own ProxyJump if it has one,
+// the others through the one before them
+func (c *SshConfig) ResolveJumps(proxyJump string) ([]SshHost, error) {
+	return c.resolveJumps(proxyJump, 0)
+}
+
+func (c *SshConfig) resolveJumps(proxyJump string, depth int) ([]SshHost, error) {
+	hosts := []SshHost{}
+	if proxyJump == "" || proxyJump == "none" {
+		return hosts, nil
+	}
+	if depth > maxProxyJumpDepth {
+		return nil, errors.New("too many nested ProxyJump hosts, is there a loop? " + proxyJump)
+	}
+	for _, jump := range strings.Split(proxyJump, ",") {
+		jump = strings.TrimSpace(jump)
+		user := ""
+		if at := strings.LastIndex(jump, "@"); at != -1 {
+			user, jump = jump[:at], jump[at+1:]
+		}
+		alias, port := jump, ""
+		if splitHost, splitPort, err := net.SplitHostPort(jump); err == nil {
+			alias, port = splitHost, splitPort
+		}
+		if alias == "" {
+			return nil, errors.New("bad jump host: " + jump)
+		}
+
+		host, err := c.Resolve(alias)
+		if err != nil {
+			return nil, err
+		}
+		if user != "" {
+			host.User = user
+		}
+		if port != "" {
+			host.Port = port
+		}
+		hosts = append(hosts, host)
+	}
+
+	before, err := c.resolveJumps(hosts[0].ProxyJump, depth+1)
+	if err != nil {
+		return nil, err
+	}
+	return append(before, hosts...), nil
+}
@@ -0,0 +1,112 @@
+package sshsync_test
+
+import (
+	"github.com/Joshua-Wright/sshsync"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSshConfigResolve(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestSshConfigResolve")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	included := filepath.Join(dir, "build.conf")
+	assert.NoError(t, ioutil.WriteFile(included, []byte(`
+Host build
+    HostName build-01.internal.example.com
+    Port 2222
+    IdentityFile ~/.ssh/build_key
+    IdentityFile %d/.ssh/%r_key
+    ProxyJump bastion.example.com
+`), 0644))
+	configFile := filepath.Join(dir, "config")
+	assert.NoError(t, ioutil.WriteFile(configFile, []byte(`
+Include `+included+`
+
+Host *.example.com
+    User deploy
+`), 0644))
+
+	config := sshsync.LoadSshConfig(configFile)
+	host, err := config.Resolve("build")
+	assert.NoError(t, err)
+	assert.Equal(t, "build-01.internal.example.com", host.HostName)
+	assert.Equal(t, "2222", host.Port)
+	// users are matched against the alias, not the host name
+	assert.Equal(t, "", host.User)
+	assert.Equal(t, "bastion.example.com", host.ProxyJump)
+	host.User = "me"
+	home := os.Getenv("HOME")
+	assert.Equal(t, []string{filepath.Join(home, ".ssh/build_key"), home + "/.ssh/me_key"}, host.KeyFiles())
+	assert.Equal(t, "build-01.internal.example.com:2222", host.Address())
+
+	host, err = config.Resolve("web.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "web.example.com", host.HostName)
+	assert.Equal(t, "22", host.Port)
+	assert.Equal(t, "deploy", host.User)
+	assert.Empty(t, host.KeyFiles())
+	assert.Equal(t, "", host.ProxyJump)
+}
+
+func TestSshConfigResolveJumps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestSshConfigResolveJumps")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	configFile := filepath.Join(dir, "config")
+	assert.NoError(t, ioutil.WriteFile(configFile, []byte(`
+Host bastion
+    HostName bastion.example.com
+    User jumper
+    Port 2200
+`), 0644))
+	config := sshsync.LoadSshConfig(configFile)
+
+	jumps, err := config.ResolveJumps("bastion,admin@inner.example.com:2222,[::1]:22")
+	assert.NoError(t, err)
+	if assert.Len(t, jumps, 3) {
+		assert.Equal(t, "jumper", jumps[0].User)
+		assert.Equal(t, "bastion.example.com:2200", jumps[0].Address())
+		assert.Equal(t, "admin", jumps[1].User)
+		assert.Equal(t, "inner.example.com:2222", jumps[1].Address())
+		assert.Equal(t, "[::1]:22", jumps[2].Address())
+	}
+
+	jumps, err = config.ResolveJumps("none")
+	assert.NoError(t, err)
+	assert.Empty(t, jumps)
+}
+
+func TestSshConfigResolveNestedJumps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestSshConfigResolveNestedJumps")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	configFile := filepath.Join(dir, "config")
+	assert.NoError(t, ioutil.WriteFile(configFile, []byte(`
+Host inner
+    ProxyJump bastion
+Host bastion
+    ProxyJump gateway
+Host loop
+    ProxyJump loop
+`), 0644))
+	config := sshsync.LoadSshConfig(configFile)
+
+	// only the first jump host's own ProxyJump counts, like in ssh
+	jumps, err := config.ResolveJumps("inner,other")
+	assert.NoError(t, err)
+	aliases := []string{}
+	for _, jump := range jumps {
+		aliases = append(aliases, jump.Alias)
+	}
+	assert.Equal(t, []string{"gateway", "bastion", "inner", "other"}, aliases)
+
+	_, err = config.ResolveJumps("loop")
+	assert.Error(t, err)
+}
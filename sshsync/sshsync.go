@@ -1,12 +1,15 @@
 package main
 
 import (
+	"fmt"
 	"github.com/Joshua-Wright/sshsync"
 	"os"
 )
 
 func main() {
-	if len(os.Args) == 2 && os.Args[1] == "-server" {
+	if len(os.Args) == 2 && os.Args[1] == "-version" {
+		fmt.Println(sshsync.FullVersion)
+	} else if len(os.Args) == 2 && os.Args[1] == "-server" {
 		//fmt.Println("server")
 		sshsync.ServerMain()
 	} else {